@@ -1,19 +1,50 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/jwmdev/ydb/client"
+	"github.com/jwmdev/ydb/protocol"
+	"github.com/jwmdev/ydb/server"
+	"github.com/jwmdev/ydb/storage"
 )
 
 func cliParseStart(args []string) {
 	startCommand := flag.NewFlagSet("start", flag.ExitOnError)
 	tmp := startCommand.Bool("tmp", false, "Use a temporary directory for persisting data (content is lost when server stops)")
 	dir := startCommand.String("dir", "", "Directory that is used to persist data")
+	storageKind := startCommand.String("storage", storage.KindFile, "Storage backend: file, memory, or bolt")
+	writeConcurrency := startCommand.Int("write-concurrency", 10, "Number of rooms that are persisted in parallel")
+	durabilityLevel := startCommand.String("durability", "fsync", "When data is confirmed to clients: memory, write, or fsync")
+	var roomDurabilities server.RoomDurabilityFlag
+	startCommand.Var(&roomDurabilities, "room-durability", "Override --durability for rooms matching a pattern (pattern=level, may be repeated)")
+	tierAfter := startCommand.Duration("tier-after", 0, "Move rooms that were not modified for this long to the blob store (0 disables tiering)")
+	tierInterval := startCommand.Duration("tier-interval", time.Hour, "How often to look for rooms to move to the blob store")
+	blobDir := startCommand.String("blob-dir", "", "Directory that is used as the blob store for tiered rooms")
+	s3Endpoint := startCommand.String("s3-endpoint", "", "S3-compatible endpoint that is used as the blob store for tiered rooms (credentials are read from YDB_S3_ACCESS_KEY and YDB_S3_SECRET_KEY)")
+	s3Bucket := startCommand.String("s3-bucket", "ydb", "Bucket of the S3-compatible blob store")
+	s3Insecure := startCommand.Bool("s3-insecure", false, "Connect to the S3-compatible blob store without TLS")
+	maxRooms := startCommand.Int("max-rooms", 100000, "Maximum number of rooms that are cached in memory. Idle rooms are evicted first (0 for no limit)")
+	outboxMaxMessages := startCommand.Int("outbox-max-messages", server.DefaultOutboxMaxMessages, "Maximum number of messages queued for a client before the slow consumer policy applies (0 for no limit)")
+	outboxMaxBytes := startCommand.Int("outbox-max-bytes", server.DefaultOutboxMaxBytes, "Maximum number of bytes queued for a client before the slow consumer policy applies (0 for no limit)")
+	slowConsumerPolicyName := startCommand.String("slow-consumer-policy", "resubscribe", "What happens to clients that exceed the outbox limits: disconnect, resubscribe, or coalesce")
+	syncChunkSize := startCommand.Int("sync-chunk-size", server.DefaultSyncChunkSize, "Maximum size in bytes of the updates that are sent to clients that catch up with a room")
+	adminToken := startCommand.String("admin-token", os.Getenv("YDB_ADMIN_TOKEN"), "Clients that authenticate with this token may compact rooms (default $YDB_ADMIN_TOKEN)")
+	minProtocolVersion := startCommand.Uint64("min-protocol-version", protocol.VersionLegacy, "Reject clients with an older protocol version (0 accepts clients that don't announce a version)")
+	metricsAddr := startCommand.String("metrics-addr", "", "Address that serves the metrics at /debug/vars, e.g. localhost:8898 (disabled if empty)")
+	shutdownTimeout := startCommand.Duration("shutdown-timeout", 10*time.Second, "How long to wait for pending writes to be persisted when the server is interrupted or terminated")
 
 	startCommand.Usage = func() {
-		fmt.Fprintf(os.Stderr, "usage: ydb start [--dir dir] [--tmp]\n\n")
+		fmt.Fprintf(os.Stderr, "usage: ydb start [--dir dir] [--tmp] [--storage backend] [--write-concurrency n] [--durability level] [--room-durability pattern=level] [--admin-token token] [--metrics-addr addr] [--shutdown-timeout duration]\n")
+		fmt.Fprintf(os.Stderr, "                 [--tier-after duration [--tier-interval duration] (--blob-dir dir | --s3-endpoint host:port [--s3-bucket bucket] [--s3-insecure])]\n\n")
 		startCommand.PrintDefaults()
 	}
 	startCommand.Parse(args)
@@ -32,18 +63,213 @@ func cliParseStart(args []string) {
 		fmt.Fprintln(os.Stderr, "warning: data will be lost when server stops!")
 		*dir = tmpdir
 	}
-	if *dir == "" {
+	if *dir == "" && *storageKind != storage.KindMemory {
 		fmt.Fprintln(os.Stderr, "ydb: missing --dir operand")
 		fmt.Fprintln(os.Stderr, "Try 'ydb start --help' for more information")
 		os.Exit(1)
 	}
+	if *writeConcurrency < 1 {
+		fmt.Fprintln(os.Stderr, "ydb: --write-concurrency must be at least 1")
+		os.Exit(1)
+	}
+	policy, err := server.ParseSlowConsumerPolicy(*slowConsumerPolicyName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ydb: %s\n", err)
+		os.Exit(1)
+	}
+	level, err := protocol.ParseDurability(*durabilityLevel)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ydb: %s\n", err)
+		os.Exit(1)
+	}
 	if len(startCommand.Args()) != 0 {
 		fmt.Fprintln(os.Stderr, "ydb: too many arguments")
 		fmt.Fprintln(os.Stderr, "Try 'ydb start --help' for more information")
 		os.Exit(1)
 	}
-	initYdb(*dir)
-	setupWebsocketsListener(":8899")
+	switch *storageKind {
+	case storage.KindFile, storage.KindMemory, storage.KindBolt:
+	default:
+		fmt.Fprintf(os.Stderr, "ydb: unknown --storage \"%s\" (expected file, memory, or bolt)\n", *storageKind)
+		os.Exit(1)
+	}
+	var blobs storage.BlobStore
+	switch {
+	case *blobDir != "" && *s3Endpoint != "":
+		fmt.Fprintln(os.Stderr, "ydb: must not set both --blob-dir and --s3-endpoint")
+		os.Exit(1)
+	case *blobDir != "":
+		if blobs, err = storage.NewDirBlobStore(*blobDir); err != nil {
+			exitBecause("ydb: unable to open blob store", err.Error())
+		}
+	case *s3Endpoint != "":
+		if blobs, err = storage.NewS3BlobStore(*s3Endpoint, os.Getenv("YDB_S3_ACCESS_KEY"), os.Getenv("YDB_S3_SECRET_KEY"), *s3Bucket, !*s3Insecure); err != nil {
+			exitBecause("ydb: unable to connect to blob store", err.Error())
+		}
+	}
+	if *tierAfter > 0 && blobs == nil {
+		fmt.Fprintln(os.Stderr, "ydb: --tier-after requires --blob-dir or --s3-endpoint")
+		os.Exit(1)
+	}
+	ydb, err := server.New(server.Options{
+		Dir:                *dir,
+		Storage:            *storageKind,
+		WriteConcurrency:   *writeConcurrency,
+		Durability:         server.DurabilityConfig{Level: level, Rooms: roomDurabilities},
+		AdminToken:         *adminToken,
+		SyncChunkSize:      *syncChunkSize,
+		MaxRooms:           *maxRooms,
+		SlowConsumer:       server.SlowConsumerConfig{MaxMessages: noLimit(*outboxMaxMessages), MaxBytes: noLimit(*outboxMaxBytes), Policy: policy},
+		MinProtocolVersion: *minProtocolVersion,
+		// tiered rooms can be rehydrated even if tiering is disabled
+		Blobs: blobs,
+	})
+	if err != nil {
+		exitBecause("ydb: unable to open storage", err.Error())
+	}
+	if *tierAfter > 0 {
+		if err = ydb.StartTiering(*tierAfter, *tierInterval); err != nil {
+			exitBecause("ydb: unable to start tiering", err.Error())
+		}
+	}
+	if *metricsAddr != "" {
+		// metrics are not authenticated, so they are not served on the public address
+		metrics := http.NewServeMux()
+		metrics.Handle("/debug/vars", ydb.MetricsHandler())
+		go func() {
+			if err := http.ListenAndServe(*metricsAddr, metrics); err != nil {
+				exitBecause("ydb: unable to serve metrics", err.Error())
+			}
+		}()
+	}
+	srv := &http.Server{Addr: ":8899", Handler: ydb.Handler()}
+	done := shutdownOnSignal(srv, ydb, *shutdownTimeout)
+	if err = srv.ListenAndServe(); err != http.ErrServerClosed {
+		exitBecause(err.Error())
+	}
+	if err = <-done; err != nil {
+		exitBecause("ydb: unable to shut down gracefully", err.Error())
+	}
+}
+
+// shutdownOnSignal stops accepting connections and shuts ydb down when the process is interrupted or terminated.
+// The returned channel receives the result of the shutdown.
+func shutdownOnSignal(srv *http.Server, ydb *server.Ydb, timeout time.Duration) <-chan error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	done := make(chan error, 1)
+	go func() {
+		<-signals
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		// websocket conns are hijacked, so srv.Shutdown does not wait for them
+		srv.Shutdown(ctx)
+		done <- ydb.Shutdown(ctx)
+	}()
+	return done
+}
+
+func cliParseLs(args []string) {
+	lsCommand := flag.NewFlagSet("ls", flag.ExitOnError)
+	dir := lsCommand.String("dir", "", "Directory that is used to persist data")
+	storageKind := lsCommand.String("storage", storage.KindFile, "Storage backend: file or bolt")
+	lsCommand.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: ydb ls --dir dir [--storage backend]\n\n")
+		lsCommand.PrintDefaults()
+	}
+	lsCommand.Parse(args)
+	if *dir == "" {
+		fmt.Fprintln(os.Stderr, "ydb: missing --dir operand")
+		fmt.Fprintln(os.Stderr, "Try 'ydb ls --help' for more information")
+		os.Exit(1)
+	}
+	// the server may be running, so the storage must not be modified
+	store, err := storage.OpenExisting(*storageKind, *dir)
+	if err != nil {
+		exitBecause("ydb: unable to open storage", err.Error())
+	}
+	defer store.Close()
+	roomnames, err := store.List()
+	if err != nil {
+		exitBecause("ydb: unable to list rooms", err.Error())
+	}
+	for _, roomname := range roomnames {
+		fmt.Println(roomname)
+	}
+}
+
+func cliParseCompact(args []string) {
+	compactCommand := flag.NewFlagSet("compact", flag.ExitOnError)
+	url := compactCommand.String("url", "ws://localhost:8899/ws", "Websocket endpoint of the Ydb instance")
+	token := compactCommand.String("token", os.Getenv("YDB_ADMIN_TOKEN"), "Admin token of the Ydb instance (default $YDB_ADMIN_TOKEN)")
+	room := compactCommand.String("room", "", "Room to compact")
+	baseOffset := compactCommand.Uint64("base-offset", 0, "Offset of the room content that the compacted content was computed from")
+	file := compactCommand.String("file", "", "File with the compacted room content")
+	timeout := compactCommand.Duration("timeout", 30*time.Second, "How long to wait for the Ydb instance to accept the compacted content")
+	compactCommand.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: ydb compact --room room --base-offset offset --file file [--url url] [--token token]\n\n")
+		compactCommand.PrintDefaults()
+	}
+	compactCommand.Parse(args)
+	if *room == "" || *file == "" || *token == "" {
+		fmt.Fprintln(os.Stderr, "ydb: missing --room, --file, or --token operand")
+		fmt.Fprintln(os.Stderr, "Try 'ydb compact --help' for more information")
+		os.Exit(1)
+	}
+	data, err := ioutil.ReadFile(*file)
+	if err != nil {
+		exitBecause("ydb: unable to read compacted content", err.Error())
+	}
+	c := client.New()
+	c.Header = http.Header{"Authorization": {"Bearer " + *token}}
+	// the server rejects the compaction with an error instead of confirming it
+	rejected := make(chan protocol.Error, 1)
+	c.OnError = func(e protocol.Error) {
+		if e.HasConf && e.Roomname == protocol.Roomname(*room) {
+			select {
+			case rejected <- e:
+			default:
+			}
+		} else {
+			fmt.Fprintf(os.Stderr, "ydb: %s\n", e)
+		}
+	}
+	if err := c.Connect(*url); err != nil {
+		exitBecause("ydb: unable to connect", err.Error())
+	}
+	c.CompactRoom(protocol.Roomname(*room), *baseOffset, data)
+	confirmed := make(chan struct{})
+	go func() {
+		c.WaitForConfs()
+		close(confirmed)
+	}()
+	select {
+	case <-confirmed:
+		c.Disconnect()
+	case <-time.After(*timeout):
+		exitBecause("ydb: the compaction was not accepted. Check the base offset and the admin token")
+	}
+	// the client calls OnError before it stops waiting for the rejected compaction
+	select {
+	case e := <-rejected:
+		exitBecause("ydb: the compaction was rejected", e.Text)
+	default:
+	}
+}
+
+// noLimit maps the flag value 0 to a negative limit, which server.SlowConsumerConfig treats as unlimited.
+func noLimit(limit int) int {
+	if limit == 0 {
+		return -1
+	}
+	return limit
+}
+
+func exitBecause(messages ...string) {
+	for _, m := range messages {
+		fmt.Fprintln(os.Stderr, m)
+	}
+	os.Exit(1)
 }
 
 func main() {
@@ -52,6 +278,8 @@ func main() {
 		fmt.Fprintf(os.Stderr, "usage: %s [--version] <command> [<args>]\n\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "available commands:\n")
 		fmt.Fprintf(os.Stderr, "   start     Start a Ydb instance\n")
+		fmt.Fprintf(os.Stderr, "   ls        List the rooms persisted in a Ydb directory\n")
+		fmt.Fprintf(os.Stderr, "   compact   Replace the content of a room with a compacted version\n")
 		fmt.Fprintf(os.Stderr, "   cli       Retrieve and modify content of a Ydb instance\n")
 		fmt.Fprintf(os.Stderr, "   stats     Print live stats about a Ydb instance\n")
 	}
@@ -67,6 +295,10 @@ func main() {
 	switch os.Args[1] {
 	case "start":
 		cliParseStart(os.Args[2:])
+	case "ls":
+		cliParseLs(os.Args[2:])
+	case "compact":
+		cliParseCompact(os.Args[2:])
 	default:
 		flag.Usage()
 		os.Exit(1)
@@ -0,0 +1,240 @@
+// Package client implements a Go client for Ydb.
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/jwmdev/ydb/protocol"
+)
+
+type roomstate struct {
+	offset int // TODO: this should reflect the offset stored by the server
+	data   []byte
+}
+
+type Client struct {
+	// sent when connecting, e.g. "Authorization: Bearer <admin token>"
+	Header http.Header
+	// called from the read pump when the server reports an error. Errors are logged if nil
+	OnError  func(e protocol.Error)
+	conn     *websocket.Conn
+	closedWG sync.WaitGroup
+	send     chan []byte
+	// protects unconfirmed and rooms
+	mux sync.Mutex
+	// outgoing messages that were not confirmed by the server
+	unconfirmed              map[uint64][]byte
+	nextExpectedConfirmation uint64
+	nextConfirmationNumber   uint64
+	rooms                    map[protocol.Roomname]roomstate
+	// protocol version and features negotiated with the server. Protected by mux
+	version  uint64
+	features uint64
+}
+
+// features that the client announces in its hello
+const clientFeatures = protocol.FeatureErrors
+
+func New() *Client {
+	return &Client{
+		send:        make(chan []byte, 10),
+		unconfirmed: make(map[uint64][]byte),
+		rooms:       make(map[protocol.Roomname]roomstate),
+	}
+}
+
+func (client *Client) readMessage(message []byte) {
+	buf := bytes.NewBuffer(message)
+	switch messageType, _ := buf.ReadByte(); messageType {
+	case protocol.MessageUpdate:
+		confirmation, _ := binary.ReadUvarint(buf)
+		roomname, _ := protocol.ReadRoomname(buf)
+		bytes, _ := protocol.ReadPayload(buf)
+		client.mux.Lock()
+		room := client.rooms[roomname]
+		room.data = append(room.data, bytes...)
+		client.rooms[roomname] = room
+		client.mux.Unlock()
+		client.send <- protocol.CreateMessageConfirmation(confirmation)
+	case protocol.MessageConfirmation:
+		conf, _ := binary.ReadUvarint(buf)
+		client.mux.Lock()
+		for conf >= client.nextExpectedConfirmation {
+			delete(client.unconfirmed, client.nextExpectedConfirmation)
+			client.nextExpectedConfirmation++
+		}
+		client.mux.Unlock()
+	case protocol.MessageHello:
+		version, _ := binary.ReadUvarint(buf)
+		features, _ := binary.ReadUvarint(buf)
+		client.mux.Lock()
+		client.version = version
+		client.features = features
+		client.mux.Unlock()
+	case protocol.MessageError:
+		e, err := protocol.ReadMessageError(buf)
+		if err != nil {
+			log.Printf("ydb-client error: malformed error message: %s", err)
+			return
+		}
+		// OnError is called before the message is removed from unconfirmed, so that it sees the error before
+		// WaitForConfs returns
+		if client.OnError != nil {
+			client.OnError(e)
+		} else {
+			log.Printf("ydb-client error: %s", e)
+		}
+		if e.HasConf {
+			// the server does not confirm the message
+			client.mux.Lock()
+			delete(client.unconfirmed, e.Conf)
+			client.mux.Unlock()
+		}
+	case protocol.MessageHostUnconfirmedByClient:
+		// the host received the message
+		conf, _ := binary.ReadUvarint(buf)
+		client.mux.Lock()
+		delete(client.unconfirmed, conf)
+		client.mux.Unlock()
+	}
+}
+
+func (client *Client) WaitForConfs() {
+	for {
+		client.mux.Lock()
+		n := len(client.unconfirmed)
+		client.mux.Unlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func (client *Client) Connect(url string) (err error) {
+	if client.conn == nil {
+		client.closedWG = sync.WaitGroup{}
+		client.closedWG.Add(2)
+		client.conn, _, err = websocket.DefaultDialer.Dial(url, client.Header)
+		if err != nil {
+			client.conn = nil
+			return err
+		}
+		// the hello must be the first message on every conn
+		client.send <- protocol.CreateMessageHello(protocol.Version, clientFeatures)
+		doneReading := make(chan struct{}, 0)
+		// read pump
+		go func() {
+			defer func() {
+				client.closedWG.Done()
+				close(doneReading)
+			}()
+			for {
+				if client.conn == nil {
+					fmt.Println("Empty conn when reading, client prematurely disconnected")
+				}
+				messageType, message, err := client.conn.ReadMessage()
+				if err != nil {
+					// also happens after Disconnect, when the server answers the close frame
+					fmt.Printf("ydb-client error: %s\n", err)
+					break
+				}
+				if messageType == websocket.BinaryMessage {
+					client.readMessage(message)
+				}
+			}
+		}()
+		// write pump
+		go func() {
+			defer func() {
+				client.conn.Close()
+				client.closedWG.Done()
+			}()
+			for m := range client.send {
+				fmt.Println("debug: write message to server: ", m)
+				if client.conn == nil {
+					fmt.Println("Empty conn when writing, client prematurely disconnected")
+				}
+				client.conn.WriteMessage(websocket.BinaryMessage, m)
+			}
+			err := client.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			if err != nil {
+				log.Println("ydb-client error: error while closing conn", err)
+				return
+			}
+			select {
+			case <-doneReading:
+			case <-time.After(time.Second):
+			}
+		}()
+	}
+	return
+}
+
+func (client *Client) Disconnect() {
+	if client.conn != nil {
+		close(client.send)
+		client.closedWG.Wait()
+		client.conn.Close()
+		client.conn = nil
+	}
+}
+
+func (client *Client) Subscribe(subs ...protocol.SubDefinition) {
+	conf := client.nextConfirmationNumber
+	m := protocol.CreateMessageSubscribe(conf, subs...)
+	client.mux.Lock()
+	client.unconfirmed[conf] = m
+	client.mux.Unlock()
+	client.nextConfirmationNumber++
+	client.send <- m
+}
+
+// Unsubscribe ends the subscriptions to roomnames, so that the server stops sending their updates.
+// Servers that don't announce protocol.FeatureUnsub reject the message with an error.
+func (client *Client) Unsubscribe(roomnames ...protocol.Roomname) {
+	conf := client.nextConfirmationNumber
+	m := protocol.CreateMessageUnsubscribe(conf, roomnames...)
+	client.mux.Lock()
+	for _, roomname := range roomnames {
+		delete(client.rooms, roomname)
+	}
+	client.unconfirmed[conf] = m
+	client.mux.Unlock()
+	client.nextConfirmationNumber++
+	client.send <- m
+}
+
+func (client *Client) UpdateRoom(roomname protocol.Roomname, data []byte) {
+	conf := client.nextConfirmationNumber
+	m := protocol.CreateMessageUpdate(roomname, conf, data)
+	client.mux.Lock()
+	roomstate := client.rooms[roomname]
+	roomstate.data = append(roomstate.data, data...)
+	client.rooms[roomname] = roomstate
+	client.unconfirmed[conf] = m
+	client.mux.Unlock()
+	client.nextConfirmationNumber++
+	client.send <- m
+}
+
+// CompactRoom replaces the content of a room with data. data must be computed from the room content up to baseOffset.
+// The server only accepts this from clients that authenticate with the admin token.
+func (client *Client) CompactRoom(roomname protocol.Roomname, baseOffset uint64, data []byte) {
+	conf := client.nextConfirmationNumber
+	m := protocol.CreateMessageCompact(roomname, conf, baseOffset, data)
+	client.mux.Lock()
+	client.rooms[roomname] = roomstate{data: data}
+	client.unconfirmed[conf] = m
+	client.mux.Unlock()
+	client.nextConfirmationNumber++
+	client.send <- m
+}
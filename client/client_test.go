@@ -0,0 +1,157 @@
+package client
+
+import (
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jwmdev/ydb/protocol"
+	"github.com/jwmdev/ydb/server"
+)
+
+const testroom = "testroom"
+
+// createYdbTest serves a Ydb instance while f runs. f receives the url of the websocket endpoint.
+func createYdbTest(f func(url string)) {
+	dir := "_test"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	ydb, err := server.New(server.Options{
+		Dir:              dir,
+		WriteConcurrency: 10,
+		Durability:       server.DurabilityConfig{Level: protocol.DurabilityFsync},
+	})
+	if err != nil {
+		panic(err)
+	}
+	defer ydb.Close()
+	s := httptest.NewServer(ydb.Handler())
+	defer s.Close()
+	f("ws" + strings.TrimPrefix(s.URL, "http") + "/ws")
+}
+
+func createTestClient(url string) (client *Client) {
+	client = New()
+	client.Connect(url)
+	client.Subscribe(protocol.SubDefinition{Roomname: testroom})
+	return
+}
+
+// TestClientSubscribeUpdate tests that all clients receive the updates of all other clients.
+func TestClientSubscribeUpdate(t *testing.T) {
+	createYdbTest(func(url string) {
+		p := 247
+		runTest := func(seed int, wg *sync.WaitGroup) {
+			client := createTestClient(url)
+			client.UpdateRoom(testroom, []byte{byte(seed)})
+			client.WaitForConfs()
+			for {
+				// a client that updates the room before it caught up receives its own update again with the
+				// content of the room, so only distinct updates are counted
+				received := make(map[byte]struct{})
+				client.mux.Lock()
+				for _, b := range client.rooms[testroom].data {
+					received[b] = struct{}{}
+				}
+				client.mux.Unlock()
+				if len(received) == p {
+					break
+				}
+				time.Sleep(time.Millisecond * 100)
+			}
+			wg.Done()
+		}
+		wg := new(sync.WaitGroup)
+		wg.Add(int(p))
+		for i := 0; i < p; i++ {
+			go runTest(i, wg)
+		}
+		wg.Wait()
+	})
+}
+
+// TestClientError tests that the client decodes errors, and that it does not wait for rejected messages.
+func TestClientError(t *testing.T) {
+	createYdbTest(func(url string) {
+		errs := make(chan protocol.Error, 1)
+		client := New()
+		client.OnError = func(e protocol.Error) {
+			errs <- e
+		}
+		client.Connect(url)
+		defer client.Disconnect()
+		// the client does not authenticate with the admin token
+		client.CompactRoom(testroom, 0, []byte{1})
+		client.WaitForConfs()
+		// the error is reported before WaitForConfs returns
+		select {
+		case e := <-errs:
+			if e.Code != protocol.ErrorCompactionRejected || e.Roomname != testroom || !e.HasConf || e.Conf != 0 {
+				t.Errorf("unexpected error %v", e)
+			}
+		default:
+			t.Fatal("expected the compaction to be rejected")
+		}
+	})
+}
+
+func TestClientConnectError(t *testing.T) {
+	client := New()
+	if err := client.Connect("ws://127.0.0.1:1/ws"); err == nil {
+		t.Fatal("expected connecting to a closed port to fail")
+	}
+	// Disconnect is a no-op without a conn
+	client.Disconnect()
+}
+
+/*
+
+
+
+func TestClientSubscribeUpdate(t *testing.T) {
+	dir := "_ydb_conn_test"
+	os.RemoveAll(dir)
+	initYdb(dir)
+	runSocketListener(":9999")
+	client1 := createTestClient()
+	client2 := createTestClient()
+	client1.update(testroom, "1")
+	client2.update(testroom, "2")
+	waitForConfs(client1, client2)
+	if client1.get(testroom) != client2.get(testroom) || len(client1.get(testroom)) != 2 {
+		t.Errorf("Expecting both clients to have the same content")
+	}
+	os.RemoveAll(dir)
+}
+
+
+func initTestClients(numberOfClients int, f func(clients []*client)) {
+	dir := "_ydb_conn_test"
+	os.RemoveAll(dir)
+	initYdb(dir)
+	setupWebsocketsListener(":9999")
+	conns := make([]*client, numberOfClients)
+	for i := 0; i < numberOfClients; i++ {
+		c := newClient()
+		c.connect(testEndpoint)
+		c.subscribe("test", 0)
+		conns[i] = c
+	}
+	f(conns)
+	os.RemoveAll(dir)
+}
+
+func TestWriteRoomDataAfterSubscription(t *testing.T) {
+	initTestClients(2, func(clients []*client) {
+		clients[0].updateRoomData("test", []byte{7})
+		waitForConnConfs(clients...)
+		compareClients(t, clients[0], conns[1])
+		if len(clients[0].roomData["test"]) != 1 || conns[0].roomData["test"][0] != 7 {
+			t.Error("not expected result")
+		}
+	})
+}
+*/
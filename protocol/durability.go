@@ -0,0 +1,41 @@
+package protocol
+
+import (
+	"fmt"
+)
+
+// Durability defines when the host confirms data to the clients (confirmedByHost).
+// The values are sent to the client in the sub confirmation.
+// make sure to update message.js in ydb-client when updating these values..
+type Durability uint8
+
+const (
+	// confirm as soon as the data is received in memory
+	DurabilityMemory Durability = 1
+	// confirm after the data is written to the room file (not fsynced)
+	DurabilityWrite Durability = 2
+	// confirm after the data is fsynced to the write-ahead log
+	DurabilityFsync Durability = 3
+)
+
+func (d Durability) String() string {
+	switch d {
+	case DurabilityMemory:
+		return "memory"
+	case DurabilityWrite:
+		return "write"
+	case DurabilityFsync:
+		return "fsync"
+	}
+	return fmt.Sprintf("durability(%d)", uint8(d))
+}
+
+// ParseDurability parses the name of a durability level (see Durability.String).
+func ParseDurability(s string) (Durability, error) {
+	for _, d := range []Durability{DurabilityMemory, DurabilityWrite, DurabilityFsync} {
+		if d.String() == s {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown durability level \"%s\" (expected memory, write, or fsync)", s)
+}
@@ -0,0 +1,106 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// ErrorCode tells clients what went wrong in a MessageError.
+// make sure to update message.js in ydb-client when updating these values..
+type ErrorCode uint64
+
+const (
+	// the client sent an unknown message type. The rest of the websocket message is skipped
+	ErrorUnknownMessage ErrorCode = 1
+	// the client sent a malformed message. The conn is closed with CloseProtocolViolation
+	ErrorMalformedMessage ErrorCode = 2
+	// the room rejects updates and subscriptions after repeated storage failures
+	ErrorRoomQuarantined ErrorCode = 3
+	// the room can't be loaded at the moment. The client may try again
+	ErrorRoomUnavailable ErrorCode = 4
+	// the client may not compact the room, or the room was modified since the base offset
+	ErrorCompactionRejected ErrorCode = 5
+)
+
+func (code ErrorCode) String() string {
+	switch code {
+	case ErrorUnknownMessage:
+		return "unknown message"
+	case ErrorMalformedMessage:
+		return "malformed message"
+	case ErrorRoomQuarantined:
+		return "room quarantined"
+	case ErrorRoomUnavailable:
+		return "room unavailable"
+	case ErrorCompactionRejected:
+		return "compaction rejected"
+	}
+	return fmt.Sprintf("error(%d)", uint64(code))
+}
+
+// Error is the content of a MessageError.
+type Error struct {
+	Code ErrorCode
+	// the room that the error concerns. Empty if the error does not concern a room
+	Roomname Roomname
+	// whether the error concerns the message with the confirmation number Conf. The message is not confirmed
+	HasConf bool
+	Conf    uint64
+	// human-readable description
+	Text string
+}
+
+func (e Error) Error() string {
+	msg := e.Code.String()
+	if e.Roomname != "" {
+		msg = fmt.Sprintf("room %s: %s", e.Roomname, msg)
+	}
+	if e.HasConf {
+		msg = fmt.Sprintf("%s (message %d)", msg, e.Conf)
+	}
+	if e.Text != "" {
+		msg += ": " + e.Text
+	}
+	return msg
+}
+
+// CreateMessageError tells the client that something went wrong.
+func CreateMessageError(e Error) []byte {
+	buf := &bytes.Buffer{}
+	WriteUvarint(buf, MessageError)
+	WriteUvarint(buf, uint64(e.Code))
+	WriteRoomname(buf, e.Roomname)
+	if e.HasConf {
+		WriteUvarint(buf, 1)
+		WriteUvarint(buf, e.Conf)
+	} else {
+		WriteUvarint(buf, 0)
+	}
+	WriteString(buf, e.Text)
+	return buf.Bytes()
+}
+
+// ReadMessageError reads the content of a MessageError. The message type must already be read.
+func ReadMessageError(m Message) (e Error, err error) {
+	code, err := binary.ReadUvarint(m)
+	if err != nil {
+		return
+	}
+	e.Code = ErrorCode(code)
+	if e.Roomname, err = ReadRoomname(m); err != nil {
+		return
+	}
+	hasConf, err := binary.ReadUvarint(m)
+	if err != nil {
+		return
+	}
+	if hasConf != 0 {
+		e.HasConf = true
+		if e.Conf, err = binary.ReadUvarint(m); err != nil {
+			return
+		}
+	}
+	e.Text, err = ReadString(m)
+	return
+}
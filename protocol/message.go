@@ -0,0 +1,199 @@
+// Package protocol implements the binary message format that Ydb servers and clients exchange over websockets.
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Roomname identifies a room (a shared document).
+type Roomname string
+
+// message type constants
+// make sure to update message.js in ydb-client when updating these values..
+const (
+	MessageUpdate                  = 0
+	MessageSub                     = 1
+	MessageConfirmation            = 2
+	MessageSubConf                 = 3
+	MessageHostUnconfirmedByClient = 4
+	MessageConfirmedByHost         = 5
+	MessageCompact                 = 6
+	MessageError                   = 7
+	MessageHello                   = 8
+	MessageUnsub                   = 9
+)
+
+// websocket close codes
+const (
+	// the protocol version of the client is not supported
+	CloseIncompatibleVersion = 4001
+	// the client sent a malformed message
+	CloseProtocolViolation = 4002
+)
+
+// MaxMessageSize is the maximum size of a message that a peer may send.
+const MaxMessageSize = 10000000
+
+// MaxRoomnameLength is the maximum length of a room name in bytes.
+const MaxRoomnameLength = 1024
+
+// Errors returned by the decoding functions. Truncated messages fail with io.ErrUnexpectedEOF.
+var (
+	ErrPayloadTooLarge = errors.New("payload exceeds the maximum message size")
+	ErrRoomnameTooLong = errors.New("room name exceeds the maximum length")
+)
+
+// a Message is structured as [length of payload, payload], where payload is [messageType, typePayload]
+type Message interface {
+	ReadByte() (byte, error)
+	Read(p []byte) (int, error)
+}
+
+// CreateMessageSubConf creates a sub confirmation for a single room. Clients with VersionLegacy don't expect
+// the durability.
+func CreateMessageSubConf(version uint64, roomname Roomname, offset uint64, rsid uint64, durability Durability) []byte {
+	buf := &bytes.Buffer{}
+	WriteUvarint(buf, MessageSubConf)
+	WriteUvarint(buf, 1)
+	WriteRoomname(buf, roomname)
+	WriteUvarint(buf, offset)
+	WriteUvarint(buf, rsid)
+	if version >= 1 {
+		WriteUvarint(buf, uint64(durability))
+	}
+	return buf.Bytes()
+}
+
+type SubDefinition struct {
+	Roomname Roomname
+	Offset   uint64
+	Rsid     uint64
+}
+
+func CreateMessageSubscribe(conf uint64, subs ...SubDefinition) []byte {
+	buf := &bytes.Buffer{}
+	WriteUvarint(buf, MessageSub)
+	WriteUvarint(buf, conf)
+	WriteUvarint(buf, uint64(len(subs)))
+	for _, sub := range subs {
+		WriteRoomname(buf, sub.Roomname)
+		WriteUvarint(buf, sub.Offset)
+		WriteUvarint(buf, sub.Rsid)
+	}
+	return buf.Bytes()
+}
+
+// CreateMessageUnsubscribe creates a message that ends the subscriptions of the session to roomnames.
+// The host confirms it like updates.
+func CreateMessageUnsubscribe(conf uint64, roomnames ...Roomname) []byte {
+	buf := &bytes.Buffer{}
+	WriteUvarint(buf, MessageUnsub)
+	WriteUvarint(buf, conf)
+	WriteUvarint(buf, uint64(len(roomnames)))
+	for _, roomname := range roomnames {
+		WriteRoomname(buf, roomname)
+	}
+	return buf.Bytes()
+}
+
+func CreateMessageUpdate(roomname Roomname, offsetOrConf uint64, data []byte) []byte {
+	buf := &bytes.Buffer{}
+	WriteUvarint(buf, MessageUpdate)
+	WriteUvarint(buf, offsetOrConf)
+	WriteRoomname(buf, roomname)
+	WritePayload(buf, data)
+	return buf.Bytes()
+}
+
+func CreateMessageHostUnconfirmedByClient(clientConf uint64, offset uint64) []byte {
+	buf := &bytes.Buffer{}
+	WriteUvarint(buf, MessageHostUnconfirmedByClient)
+	WriteUvarint(buf, clientConf)
+	WriteUvarint(buf, offset)
+	return buf.Bytes()
+}
+
+func CreateMessageConfirmedByHost(roomname Roomname, offset uint64) []byte {
+	buf := &bytes.Buffer{}
+	WriteUvarint(buf, MessageConfirmedByHost)
+	WriteRoomname(buf, roomname)
+	WriteUvarint(buf, offset)
+	return buf.Bytes()
+}
+
+func CreateMessageConfirmation(conf uint64) []byte {
+	buf := &bytes.Buffer{}
+	WriteUvarint(buf, MessageConfirmation)
+	WriteUvarint(buf, conf)
+	return buf.Bytes()
+}
+
+// CreateMessageCompact creates a message that replaces the content of a room.
+// data must be computed from the room content up to baseOffset.
+func CreateMessageCompact(roomname Roomname, conf uint64, baseOffset uint64, data []byte) []byte {
+	buf := &bytes.Buffer{}
+	WriteUvarint(buf, MessageCompact)
+	WriteUvarint(buf, conf)
+	WriteRoomname(buf, roomname)
+	WriteUvarint(buf, baseOffset)
+	WritePayload(buf, data)
+	return buf.Bytes()
+}
+
+func ReadString(m Message) (string, error) {
+	bs, err := ReadPayload(m)
+	return string(bs), err
+}
+
+func ReadRoomname(m Message) (Roomname, error) {
+	name, err := readBytes(m, MaxRoomnameLength, ErrRoomnameTooLong)
+	return Roomname(name), err
+}
+
+func ReadPayload(m Message) ([]byte, error) {
+	return readBytes(m, MaxMessageSize, ErrPayloadTooLarge)
+}
+
+// readBytes reads a length-prefixed byte string. Fails with errTooLong if the length exceeds max.
+func readBytes(m Message, max uint64, errTooLong error) ([]byte, error) {
+	n, err := binary.ReadUvarint(m)
+	if err != nil {
+		return nil, err
+	}
+	if n > max {
+		return nil, errTooLong
+	}
+	// don't allocate more than the rest of the message, e.g. if m is a *bytes.Buffer
+	if rest, ok := m.(interface{ Len() int }); ok && n > uint64(rest.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	bs := make([]byte, n)
+	if _, err = io.ReadFull(m, bs); err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return bs, err
+}
+
+func WriteUvarint(buf io.Writer, n uint64) error {
+	bs := make([]byte, binary.MaxVarintLen64)
+	len := binary.PutUvarint(bs, n)
+	buf.Write(bs[:len])
+	return nil
+}
+
+func WriteString(buf io.Writer, str string) error {
+	return WritePayload(buf, []byte(str))
+}
+
+func WriteRoomname(buf io.Writer, roomname Roomname) error {
+	return WriteString(buf, string(roomname))
+}
+
+func WritePayload(buf io.Writer, payload []byte) error {
+	WriteUvarint(buf, uint64(len(payload)))
+	buf.Write(payload)
+	return nil
+}
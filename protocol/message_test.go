@@ -0,0 +1,121 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// decodeMessage decodes a message that was created by a CreateMessage* function into its fields.
+func decodeMessage(t *testing.T, m []byte) []interface{} {
+	buf := bytes.NewBuffer(m)
+	uvarint := func() uint64 {
+		n, err := binary.ReadUvarint(buf)
+		if err != nil {
+			t.Fatalf("unable to read uvarint: %s", err)
+		}
+		return n
+	}
+	roomname := func() Roomname {
+		r, err := ReadRoomname(buf)
+		if err != nil {
+			t.Fatalf("unable to read room name: %s", err)
+		}
+		return r
+	}
+	payload := func() []byte {
+		p, err := ReadPayload(buf)
+		if err != nil {
+			t.Fatalf("unable to read payload: %s", err)
+		}
+		return p
+	}
+	messageType := uvarint()
+	fields := []interface{}{messageType}
+	switch messageType {
+	case MessageSubConf:
+		fields = append(fields, uvarint(), roomname(), uvarint(), uvarint(), uvarint())
+	case MessageSub:
+		fields = append(fields, uvarint(), uvarint(), roomname(), uvarint(), uvarint())
+	case MessageUpdate:
+		fields = append(fields, uvarint(), roomname(), payload())
+	case MessageHostUnconfirmedByClient, MessageHello:
+		fields = append(fields, uvarint(), uvarint())
+	case MessageConfirmedByHost:
+		fields = append(fields, roomname(), uvarint())
+	case MessageConfirmation:
+		fields = append(fields, uvarint())
+	case MessageCompact:
+		fields = append(fields, uvarint(), roomname(), uvarint(), payload())
+	case MessageUnsub:
+		conf, n := uvarint(), uvarint()
+		fields = append(fields, conf, n)
+		for i := uint64(0); i < n; i++ {
+			fields = append(fields, roomname())
+		}
+	case MessageError:
+		e, err := ReadMessageError(buf)
+		if err != nil {
+			t.Fatalf("unable to read error: %s", err)
+		}
+		fields = append(fields, e)
+	default:
+		t.Fatalf("unknown message type %d", messageType)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("message type %d: %d bytes were not decoded", messageType, buf.Len())
+	}
+	return fields
+}
+
+// FuzzMessageRoundTrip tests that all messages decode to the fields they were created from.
+func FuzzMessageRoundTrip(f *testing.F) {
+	f.Add("testroom", uint64(0), uint64(0), []byte{})
+	f.Add("", uint64(1<<63), uint64(42), []byte{1, 2, 3})
+	f.Add("räume/../a", uint64(127), uint64(128), make([]byte, 300))
+	f.Fuzz(func(t *testing.T, name string, n uint64, m uint64, data []byte) {
+		if len(name) > MaxRoomnameLength || len(data) > MaxMessageSize {
+			t.Skip()
+		}
+		roomname := Roomname(name)
+		if data == nil {
+			data = []byte{}
+		}
+		durability := Durability(m % 4)
+		e := Error{Code: ErrorCode(m), Roomname: roomname, Text: string(data)}
+		if n%2 == 0 {
+			e.HasConf = true
+			e.Conf = m
+		}
+		for _, c := range []struct {
+			m      []byte
+			fields []interface{}
+		}{
+			{CreateMessageSubConf(Version, roomname, n, m, durability), []interface{}{uint64(MessageSubConf), uint64(1), roomname, n, m, uint64(durability)}},
+			{CreateMessageSubscribe(n, SubDefinition{roomname, m, n}), []interface{}{uint64(MessageSub), n, uint64(1), roomname, m, n}},
+			{CreateMessageUpdate(roomname, n, data), []interface{}{uint64(MessageUpdate), n, roomname, data}},
+			{CreateMessageHostUnconfirmedByClient(n, m), []interface{}{uint64(MessageHostUnconfirmedByClient), n, m}},
+			{CreateMessageConfirmedByHost(roomname, n), []interface{}{uint64(MessageConfirmedByHost), roomname, n}},
+			{CreateMessageConfirmation(n), []interface{}{uint64(MessageConfirmation), n}},
+			{CreateMessageCompact(roomname, n, m, data), []interface{}{uint64(MessageCompact), n, roomname, m, data}},
+			{CreateMessageError(e), []interface{}{uint64(MessageError), e}},
+			{CreateMessageHello(n, m), []interface{}{uint64(MessageHello), n, m}},
+			{CreateMessageUnsubscribe(n, roomname, roomname), []interface{}{uint64(MessageUnsub), n, uint64(2), roomname, roomname}},
+		} {
+			if fields := decodeMessage(t, c.m); !reflect.DeepEqual(fields, c.fields) {
+				t.Errorf("expected %v, got %v", c.fields, fields)
+			}
+		}
+		// legacy clients read sub confirmations without durability
+		legacy := &bytes.Buffer{}
+		WriteUvarint(legacy, MessageSubConf)
+		WriteUvarint(legacy, 1)
+		WriteRoomname(legacy, roomname)
+		WriteUvarint(legacy, n)
+		WriteUvarint(legacy, m)
+		if !bytes.Equal(CreateMessageSubConf(VersionLegacy, roomname, n, m, durability), legacy.Bytes()) {
+			t.Error("expected legacy sub confirmations without durability")
+		}
+	})
+}
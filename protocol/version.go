@@ -0,0 +1,33 @@
+package protocol
+
+import (
+	"bytes"
+)
+
+// Version is the newest protocol version. Clients announce their version with MessageHello, which must be their
+// first message. The server replies with a hello that contains the negotiated version, the older of both versions.
+// make sure to update message.js in ydb-client when updating these values..
+const (
+	// clients that don't send a hello. Sub messages don't carry a confirmation number
+	VersionLegacy = 0
+	// sub messages carry a confirmation number, which the host confirms like updates.
+	// Sub confirmations carry the durability of each room
+	Version = 1
+)
+
+// Feature flags are announced in the hello. A feature is used if both peers announce it.
+const (
+	// the peer handles MessageError
+	FeatureErrors uint64 = 1 << iota
+	// the host handles MessageUnsub
+	FeatureUnsub
+)
+
+// CreateMessageHello announces the protocol version and the supported features.
+func CreateMessageHello(version uint64, features uint64) []byte {
+	buf := &bytes.Buffer{}
+	WriteUvarint(buf, MessageHello)
+	WriteUvarint(buf, version)
+	WriteUvarint(buf, features)
+	return buf.Bytes()
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jwmdev/ydb/protocol"
+)
+
+// compactRoom replaces the content of a room with a compacted version (e.g. after garbage collection with Yjs).
+// The compacted content must be computed from the room content up to baseOffset. The room is not compacted
+// if other clients appended data since.
+// The room gets a new roomsessionid, so all subscribers are forced to resync.
+func (ydb *Ydb) compactRoom(roomname protocol.Roomname, session *session, clientConf uint64, baseOffset uint32, data []byte) (err error) {
+	accessErr := ydb.modifyRoom(roomname, func(room *room) bool {
+		if room.offset != baseOffset {
+			err = fmt.Errorf("room %s has offset %d, but compaction is based on offset %d", roomname, room.offset, baseOffset)
+			return false
+		}
+		// data that was not persisted yet is part of the compacted content
+		room.pendingWrites = nil
+		if err = ydb.fswriter.replaceRoom(roomname, room, ydb.genUint32(), data); err != nil {
+			// the storage may contain the old content with the new roomsessionid
+			fmt.Printf("ydb error: unable to compact room %s: %s\n", roomname, err)
+			ydb.fswriter.quarantineRoom(roomname, room)
+			err = errRoomQuarantined
+			return false
+		}
+		// resync all subscribers with the compacted content
+		resync := room.subs
+		for _, sub := range room.pendingSubs {
+			if !room.hasSession(sub.session) {
+				resync = append(resync, sub.session)
+			}
+		}
+		room.subs = nil
+		room.pendingSubs = nil
+		for _, s := range resync {
+			s.send(protocol.CreateMessageSubConf(s.protocolVersion(), roomname, 0, uint64(room.roomsessionid), room.durability))
+			room.pendingSubs = append(room.pendingSubs, pendingSub{session: s})
+		}
+		session.sendHostUnconfirmedByClient(clientConf, uint64(room.offset))
+		// the fswriter sends the compacted content to the subscribers
+		return len(room.pendingSubs) > 0
+	})
+	if accessErr != nil {
+		return accessErr
+	}
+	return
+}
+
+// replaceRoom atomically replaces the content of a room and assigns a new roomsessionid.
+// Waits until the write task persisted the room, if it is writing.
+// Expects room.mux to be locked.
+func (fswriter *fswriter) replaceRoom(roomname protocol.Roomname, room *room, rsid uint32, data []byte) error {
+	room.writeMux.Lock()
+	defer room.writeMux.Unlock()
+	room.roomsessionid = rsid
+	room.offset = uint32(len(data))
+	room.modified = time.Now()
+	if room.created.IsZero() {
+		room.created = room.modified
+	}
+	// the meta must be written first. Appends in the write-ahead log that belong to the old rsid are then skipped
+	if err := fswriter.writeRoomMeta(roomname, room, false, true); err != nil {
+		return err
+	}
+	room.metaDirty = true
+	return fswriter.storage.Replace(roomname, data)
+}
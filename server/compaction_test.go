@@ -0,0 +1,82 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/jwmdev/ydb/protocol"
+)
+
+// recordingConn records all messages that are sent to a session.
+type recordingConn struct {
+	mux      sync.Mutex
+	messages [][]byte
+}
+
+func (c *recordingConn) WriteMessage(m []byte, pm *websocket.PreparedMessage) {
+	c.mux.Lock()
+	c.messages = append(c.messages, m)
+	c.mux.Unlock()
+}
+
+func (c *recordingConn) Close(code int, reason string) {}
+
+func (c *recordingConn) contains(m []byte) bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	for _, recorded := range c.messages {
+		if bytes.Equal(recorded, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// TestCompactRoom tests that compaction replaces the room content, and that subscribers are resynced.
+func TestCompactRoom(t *testing.T) {
+	dir := "_test_compaction"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	ydb := newTestYdb(t, dir)
+	defer ydb.Close()
+	writer := newSession(ydb, 1)
+	subscriber := newSession(ydb, 2)
+	conn := &recordingConn{}
+	subscriber.add(conn)
+
+	ydb.updateRoom(testroom, writer, 0, []byte{1, 2, 3})
+	waitForRoomPersisted(ydb, testroom)
+	ydb.subscribeRoom(testroom, subscriber, 0, 0)
+	waitForRoomPersisted(ydb, testroom)
+	rsid := ydb.getRoom(testroom).roomsessionid
+
+	if err := ydb.compactRoom(testroom, writer, 1, 2, []byte{9}); err == nil {
+		t.Error("expected compaction with outdated base offset to fail")
+	}
+	if err := ydb.compactRoom(testroom, writer, 2, 3, []byte{9}); err != nil {
+		t.Fatal(err)
+	}
+	waitForRoomPersisted(ydb, testroom)
+	waitForDelivery(subscriber)
+	room := ydb.getRoom(testroom)
+	if room.roomsessionid == rsid || room.offset != 1 {
+		t.Errorf("expected new rsid and offset 1, got rsid %d (old %d) and offset %d", room.roomsessionid, rsid, room.offset)
+	}
+	r, _ := ydb.fswriter.storage.ReadFrom(testroom, 0)
+	data, _ := ioutil.ReadAll(r)
+	r.Close()
+	if !bytes.Equal(data, []byte{9}) {
+		t.Errorf("expected compacted room content [9], got %v", data)
+	}
+	if !conn.contains(protocol.CreateMessageSubConf(protocol.VersionLegacy, testroom, 0, uint64(room.roomsessionid), room.durability)) {
+		t.Error("expected subscriber to receive a sub confirmation with the new rsid")
+	}
+	if !conn.contains(protocol.CreateMessageUpdate(testroom, 1, []byte{9})) {
+		t.Error("expected subscriber to receive the compacted content")
+	}
+}
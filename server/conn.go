@@ -0,0 +1,13 @@
+package server
+
+import (
+	"github.com/gorilla/websocket"
+)
+
+type conn interface {
+	// sends data to the client
+	WriteMessage(m []byte, pm *websocket.PreparedMessage)
+	// closes the connection to the client with a websocket close code, e.g. if the client does not read messages
+	// fast enough or if the server shuts down
+	Close(code int, reason string)
+}
@@ -1,14 +1,16 @@
-package main
+package server
 
 import (
 	"bytes"
+
+	"github.com/jwmdev/ydb/protocol"
 )
 
 // testConn does not support reconnection
 type testConn struct {
 	// messages sent by conn to server
 	incoming chan []byte
-	roomData map[roomname][]byte
+	roomData map[protocol.Roomname][]byte
 	outgoing chan []byte
 	// next expected confirmation number from the server
 	expectedConfirmation uint64
@@ -21,7 +23,7 @@ type testConn struct {
 func newTestConn() *testConn {
 	c := &testConn{
 		incoming: make(chan []byte, 50),
-		roomData: make(map[roomname][]byte, 1),
+		roomData: make(map[protocol.Roomname][]byte, 1),
 		outgoing: make(chan []byte, 50),
 	}
 	return c
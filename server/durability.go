@@ -0,0 +1,59 @@
+package server
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/jwmdev/ydb/protocol"
+)
+
+// RoomDurability overrides the durability level for all rooms that match pattern (see path.Match).
+type RoomDurability struct {
+	Pattern string
+	Level   protocol.Durability
+}
+
+// DurabilityConfig is the server-wide durability level and its per-room overrides.
+type DurabilityConfig struct {
+	Level protocol.Durability
+	// the first matching override is used
+	Rooms []RoomDurability
+}
+
+func (config DurabilityConfig) forRoom(roomname protocol.Roomname) protocol.Durability {
+	for _, r := range config.Rooms {
+		if matched, _ := path.Match(r.Pattern, string(roomname)); matched {
+			return r.Level
+		}
+	}
+	return config.Level
+}
+
+// RoomDurabilityFlag parses repeated "pattern=level" command line arguments.
+type RoomDurabilityFlag []RoomDurability
+
+func (f *RoomDurabilityFlag) String() string {
+	var s []string
+	for _, r := range *f {
+		s = append(s, fmt.Sprintf("%s=%s", r.Pattern, r.Level))
+	}
+	return strings.Join(s, ",")
+}
+
+func (f *RoomDurabilityFlag) Set(value string) error {
+	i := strings.LastIndex(value, "=")
+	if i <= 0 {
+		return fmt.Errorf("expected pattern=level, got \"%s\"", value)
+	}
+	pattern := value[:i]
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid room pattern \"%s\": %s", pattern, err)
+	}
+	level, err := protocol.ParseDurability(value[i+1:])
+	if err != nil {
+		return err
+	}
+	*f = append(*f, RoomDurability{pattern, level})
+	return nil
+}
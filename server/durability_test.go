@@ -0,0 +1,31 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/jwmdev/ydb/protocol"
+)
+
+func TestRoomDurabilityOverride(t *testing.T) {
+	var rooms RoomDurabilityFlag
+	for _, arg := range []string{"drafts/*=memory", "logs-*=write"} {
+		if err := rooms.Set(arg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rooms.Set("nolevel"); err == nil {
+		t.Error("expected an error for a missing level")
+	}
+	config := DurabilityConfig{protocol.DurabilityFsync, rooms}
+	tests := map[protocol.Roomname]protocol.Durability{
+		"drafts/a":   protocol.DurabilityMemory,
+		"drafts/a/b": protocol.DurabilityFsync,
+		"logs-2019":  protocol.DurabilityWrite,
+		"document":   protocol.DurabilityFsync,
+	}
+	for roomname, expected := range tests {
+		if d := config.forRoom(roomname); d != expected {
+			t.Errorf("room %s: expected %s, got %s", roomname, expected, d)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package server
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/jwmdev/ydb/protocol"
+	"github.com/jwmdev/ydb/storage"
+)
+
+// DefaultSyncChunkSize is the maximum size of the updates that are sent to subscribers that catch up with a room.
+// It must be well below protocol.MaxMessageSize.
+const DefaultSyncChunkSize = 1 << 20
+
+type roomUpdate struct {
+	room     *room
+	roomname protocol.Roomname
+}
+
+// fswriter persists rooms to the storage.
+type fswriter struct {
+	// owning instance
+	ydb *Ydb
+	// one queue per write task. A room is always handled by the same write task
+	queues  []chan roomUpdate
+	storage storage.Storage
+	// nil if the storage does not use a write-ahead log
+	wal *storage.WAL
+	// nil if tiering is disabled
+	blobs storage.BlobStore
+	index *roomIndex
+	// closed by stop. Rooms that are registered afterwards are not persisted
+	stopped chan struct{}
+	// running write tasks
+	writeTasks sync.WaitGroup
+}
+
+func (fswriter *fswriter) registerRoomUpdate(room *room, roomname protocol.Roomname) {
+	select {
+	case fswriter.queues[fswriter.writeTaskIndex(roomname)] <- roomUpdate{room, roomname}:
+	case <-fswriter.stopped:
+	}
+}
+
+// stop ends the write tasks after they persisted the room that they are writing, and closes the write-ahead log.
+func (fswriter *fswriter) stop() {
+	close(fswriter.stopped)
+	fswriter.writeTasks.Wait()
+	if fswriter.wal != nil {
+		if err := fswriter.wal.Close(); err != nil {
+			fmt.Printf("ydb error: unable to close the wal: %s\n", err)
+		}
+	}
+}
+
+// writeTaskIndex hashes roomname to a write task.
+// Appends to a room stay ordered, while different rooms are persisted in parallel.
+func (fswriter *fswriter) writeTaskIndex(roomname protocol.Roomname) int {
+	h := fnv.New32a()
+	h.Write([]byte(roomname))
+	return int(h.Sum32() % uint32(len(fswriter.queues)))
+}
+
+func (fswriter *fswriter) startWriteTask(queue chan roomUpdate) {
+	defer fswriter.writeTasks.Done()
+	for {
+		var writeTask roomUpdate
+		select {
+		case writeTask = <-queue:
+		case <-fswriter.stopped:
+			return
+		}
+		room := writeTask.room
+		roomname := writeTask.roomname
+		room.mux.Lock()
+		debug("fswriter: created room lock")
+		if !fswriter.writePendingWrites(roomname, room) {
+			// the write is retried, so the room stays registered
+			room.mux.Unlock()
+			continue
+		}
+		// the storage now contains all data up to room.offset
+		var catchingUp []pendingSub
+		for _, sub := range room.pendingSubs {
+			if !room.hasSession(sub.session) {
+				confirmedOffset, complete, err := fswriter.sendRoomTail(roomname, sub.session, sub.offset)
+				if err != nil {
+					// the session continues at the offset up to which the content was sent
+					sub.offset = uint32(confirmedOffset)
+					if fswriter.readFailed(roomname, &sub, err) {
+						catchingUp = append(catchingUp, sub)
+					}
+					continue
+				}
+				if !complete {
+					catchingUp = append(catchingUp, pendingSub{session: sub.session, offset: uint32(confirmedOffset)})
+					continue
+				}
+				sub.session.sendConfirmedByHost(roomname, confirmedOffset)
+				room.subs = append(room.subs, sub.session)
+			}
+		}
+		room.pendingSubs = catchingUp
+		room.registered = false
+		room.mux.Unlock()
+		debug("fswriter: removed lock")
+	}
+}
+
+// roomWrite is the data that a write task persists without holding room.mux.
+type roomWrite struct {
+	// pendingWrites start at offset base of the room
+	base          uint32
+	pendingWrites []byte
+	rsid          uint32
+	durability    protocol.Durability
+	// the meta that marks the room as unclean before data is written
+	meta     storage.RoomMeta
+	syncMeta bool
+	// set by writeRoom once the meta is persisted
+	metaWritten bool
+}
+
+// writePendingWrites persists the pending writes of the room until none are left, and confirms them to the
+// subscribers. The storage is written while room.mux is unlocked, so that updates and subscriptions don't wait for
+// the disk. Returns false if a failed write is retried later.
+// Expects room.mux to be locked. It is locked again when writePendingWrites returns.
+func (fswriter *fswriter) writePendingWrites(roomname protocol.Roomname, room *room) bool {
+	for len(room.pendingWrites) > 0 && !room.quarantined {
+		now := time.Now()
+		if room.created.IsZero() {
+			room.created = now
+		}
+		room.modified = now
+		write := &roomWrite{
+			base:          room.offset - uint32(len(room.pendingWrites)),
+			pendingWrites: room.pendingWrites,
+			rsid:          room.roomsessionid,
+			durability:    room.durability,
+			meta:          room.roomMeta(roomname, false),
+			// the first time a room is marked unclean, it must be persisted before clients rely on the data
+			syncMeta: !room.metaDirty,
+		}
+		room.pendingWrites = nil
+		// the room stays registered, so it is neither evicted nor tiered while it is written
+		room.writeMux.Lock()
+		room.mux.Unlock()
+		err := fswriter.writeRoom(roomname, write)
+		room.writeMux.Unlock()
+		room.mux.Lock()
+		if room.roomsessionid != write.rsid || room.quarantined {
+			// the room was compacted or quarantined in the meantime. Compacted content includes the written data
+			continue
+		}
+		if write.metaWritten {
+			room.metaDirty = true
+		}
+		if err != nil {
+			if fswriter.writeFailed(roomname, room, write.pendingWrites, write.base, err) {
+				return false
+			}
+			continue
+		}
+		room.writeFailures = 0
+		// confirm after we can assure that data has been persisted with the durability level of the room.
+		// With protocol.DurabilityMemory, updateRoom already confirmed the data.
+		if room.durability != protocol.DurabilityMemory {
+			room.sendConfirmedByHost(roomname, write.base+uint32(len(write.pendingWrites)))
+		}
+		debug("fswriter: left dataAvailable - sent confirmedByHost")
+	}
+	return true
+}
+
+// writeRoom persists write.pendingWrites.
+// Expects room.writeMux to be locked.
+func (fswriter *fswriter) writeRoom(roomname protocol.Roomname, write *roomWrite) error {
+	// mark the room as unclean before data is written
+	if err := fswriter.saveRoomMeta(write.meta, write.syncMeta); err != nil {
+		return err
+	}
+	write.metaWritten = true
+	var walSegment *storage.WALSegment
+	if write.durability == protocol.DurabilityFsync && fswriter.wal != nil {
+		debug("fswriter: enter dataAvailable - commit to wal")
+		var err error
+		walSegment, err = fswriter.wal.Commit(roomname, write.rsid, write.base, write.pendingWrites)
+		if err != nil {
+			return err
+		}
+		// the segment may be checkpointed once the append is done. If the append fails, it is committed again
+		defer walSegment.Applied()
+	}
+	debug("fswriter: write to storage")
+	if err := fswriter.storage.Append(roomname, write.pendingWrites); err != nil {
+		return err
+	}
+	if walSegment == nil && write.durability == protocol.DurabilityFsync {
+		if err := fswriter.storage.Sync(roomname); err != nil {
+			return err
+		}
+	}
+	debug("fswriter: wrote to storage")
+	return nil
+}
+
+// sendRoomTail streams the content of a room from offset to a session, in updates of at most ydb.syncChunkSize bytes.
+// Stops early if the outbox of the session is full. Then the session continues when its outbox is drained.
+// Returns the offset up to which the content was sent. If the content can't be read, the session must not be
+// subscribed, because it would miss the content after end.
+func (fswriter *fswriter) sendRoomTail(roomname protocol.Roomname, session *session, offset uint32) (end uint64, complete bool, err error) {
+	end = uint64(offset)
+	chunkSize := fswriter.ydb.syncChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultSyncChunkSize
+	}
+	r, err := fswriter.storage.ReadFrom(roomname, offset)
+	if err == nil {
+		chunk := make([]byte, chunkSize)
+		for {
+			if !session.outboxHasRoom() {
+				r.Close()
+				session.waitForCatchup(roomname)
+				return end, false, nil
+			}
+			var n int
+			n, err = io.ReadFull(r, chunk)
+			if n > 0 {
+				end += uint64(n)
+				session.sendUpdate(roomname, chunk[:n], end)
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				err = nil
+				break
+			}
+			if err != nil {
+				// the content up to the corrupted frame was sent
+				break
+			}
+		}
+		r.Close()
+	}
+	return end, err == nil, err
+}
+
+// newFSWriter starts writeConcurrency write tasks. If walDir is not empty, rooms with protocol.DurabilityFsync are committed
+// to a write-ahead log in walDir before they are written to the storage.
+// The room index is saved to indexPath, unless it is empty. It must be loaded before rooms are accessed.
+func newFSWriter(ydb *Ydb, store storage.Storage, walDir string, indexPath string, fsAccessQueueLen uint, writeConcurrency int) (*fswriter, error) {
+	fswriter := &fswriter{
+		ydb:     ydb,
+		storage: store,
+		index:   newRoomIndex(indexPath),
+		stopped: make(chan struct{}),
+	}
+	if walDir != "" {
+		wal, err := storage.NewWAL(walDir, store)
+		if err != nil {
+			return nil, err
+		}
+		fswriter.wal = wal
+	}
+	if writeConcurrency < 1 {
+		writeConcurrency = 1
+	}
+	fswriter.queues = make([]chan roomUpdate, writeConcurrency)
+	for i := range fswriter.queues {
+		queue := make(chan roomUpdate, fsAccessQueueLen)
+		fswriter.queues[i] = queue
+		fswriter.writeTasks.Add(1)
+		go fswriter.startWriteTask(queue)
+	}
+	return fswriter, nil
+}
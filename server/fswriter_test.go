@@ -0,0 +1,142 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jwmdev/ydb/protocol"
+	"github.com/jwmdev/ydb/storage"
+)
+
+// TestSendRoomTail tests that subscribers catch up with a room in chunks, and that only the last chunk is confirmed.
+func TestSendRoomTail(t *testing.T) {
+	dir := "_test_roomtail"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	ydb := newTestYdb(t, dir)
+	defer ydb.Close()
+	ydb.syncChunkSize = 2
+	writer := newSession(ydb, 1)
+	subscriber := newSession(ydb, 2)
+	conn := &recordingConn{}
+	subscriber.add(conn)
+	ydb.updateRoom(testroom, writer, 0, []byte{1, 2, 3, 4, 5})
+	waitForRoomPersisted(ydb, testroom)
+	ydb.subscribeRoom(testroom, subscriber, 0, 0)
+	waitForRoomPersisted(ydb, testroom)
+	waitForDelivery(subscriber)
+	expected := [][]byte{
+		protocol.CreateMessageUpdate(testroom, 2, []byte{1, 2}),
+		protocol.CreateMessageUpdate(testroom, 4, []byte{3, 4}),
+		protocol.CreateMessageUpdate(testroom, 5, []byte{5}),
+		protocol.CreateMessageConfirmedByHost(testroom, 5),
+	}
+	conn.mux.Lock()
+	defer conn.mux.Unlock()
+	messages := conn.messages[len(conn.messages)-len(expected):]
+	for i, m := range expected {
+		if !bytes.Equal(messages[i], m) {
+			t.Errorf("message %d: expected %v, got %v", i, m, messages[i])
+		}
+	}
+}
+
+// TestSendRoomTailFlowControl tests that a subscriber catches up only as fast as it reads its messages.
+func TestSendRoomTailFlowControl(t *testing.T) {
+	dir := "_test_roomtail_flow"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	ydb := newTestYdb(t, dir)
+	defer ydb.Close()
+	ydb.syncChunkSize = 1
+	ydb.slowConsumer = SlowConsumerConfig{MaxMessages: 4, Policy: SlowConsumerDisconnect}
+	writer := newSession(ydb, 1)
+	conn := &recordingConn{}
+	subscriber := newUndeliveredSession(ydb, 2, conn)
+	ydb.updateRoom(testroom, writer, 0, []byte{1, 2, 3, 4, 5})
+	waitForRoomPersisted(ydb, testroom)
+	ydb.subscribeRoom(testroom, subscriber, 0, 0)
+	waitForRoomPersisted(ydb, testroom)
+	subscriber.mux.Lock()
+	queued := len(subscriber.outbox)
+	subscriber.mux.Unlock()
+	if queued > 3 {
+		t.Errorf("expected the catch-up to pause, but %d messages are queued", queued)
+	}
+	subscriber.conns = nil
+	subscriber.conn = nil
+	subscriber.add(conn)
+	waitFor(t, "the subscriber to catch up", func() bool {
+		return conn.contains(protocol.CreateMessageConfirmedByHost(testroom, 5))
+	})
+	for i := uint64(1); i <= 5; i++ {
+		if !conn.contains(protocol.CreateMessageUpdate(testroom, i, []byte{byte(i)})) {
+			t.Errorf("expected update with offset %d", i)
+		}
+	}
+}
+
+// blockingStorage blocks appends until release is closed.
+type blockingStorage struct {
+	storage.Storage
+	appending chan struct{}
+	release   chan struct{}
+}
+
+func (s *blockingStorage) Append(roomname protocol.Roomname, data []byte) error {
+	select {
+	case s.appending <- struct{}{}:
+	default:
+	}
+	<-s.release
+	return s.Storage.Append(roomname, data)
+}
+
+// TestUpdateDuringWrite tests that rooms accept updates while the write task persists them, and that the updates
+// are persisted and confirmed in order.
+func TestUpdateDuringWrite(t *testing.T) {
+	dir := "_test_update_during_write"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	ydb := newTestYdb(t, dir)
+	defer ydb.Close()
+	store := &blockingStorage{Storage: ydb.fswriter.storage, appending: make(chan struct{}, 1), release: make(chan struct{})}
+	ydb.fswriter.storage = store
+	subscriber := newSession(ydb, 1)
+	conn := &recordingConn{}
+	subscriber.add(conn)
+	ydb.subscribeRoom(testroom, subscriber, 0, 0)
+	writer := newSession(ydb, 2)
+	ydb.updateRoom(testroom, writer, 0, []byte{1, 2, 3})
+	<-store.appending
+	updated := make(chan struct{})
+	go func() {
+		ydb.updateRoom(testroom, writer, 1, []byte{4})
+		subscribeRoom := newSession(ydb, 3)
+		ydb.subscribeRoom(testroom, subscribeRoom, 0, 4)
+		close(updated)
+	}()
+	select {
+	case <-updated:
+	case <-time.After(5 * time.Second):
+		close(store.release)
+		t.Fatal("expected the room to accept updates while it is written")
+	}
+	if conn.contains(protocol.CreateMessageConfirmedByHost(testroom, 3)) {
+		t.Error("expected the update not to be confirmed before it is persisted")
+	}
+	close(store.release)
+	waitFor(t, "the updates to be confirmed", func() bool {
+		return conn.contains(protocol.CreateMessageConfirmedByHost(testroom, 3)) &&
+			conn.contains(protocol.CreateMessageConfirmedByHost(testroom, 4))
+	})
+	r, _ := store.ReadFrom(testroom, 0)
+	data, _ := ioutil.ReadAll(r)
+	r.Close()
+	if !bytes.Equal(data, []byte{1, 2, 3, 4}) {
+		t.Errorf("expected persisted content [1 2 3 4], got %v", data)
+	}
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/jwmdev/ydb/protocol"
+)
+
+// features that ydb announces in its hello
+const serverFeatures = protocol.FeatureErrors | protocol.FeatureUnsub
+
+// closeError is returned by message handlers if the conn must be closed with a websocket close code.
+type closeError struct {
+	code   int
+	reason string
+}
+
+func (err *closeError) Error() string {
+	return err.reason
+}
+
+// readFirstMessage negotiates the protocol version before the first message of a session is handled.
+// Clients that don't start with a hello use protocol.VersionLegacy.
+func readFirstMessage(m protocol.Message, session *session, messageType uint64) (handled bool, err error) {
+	session.handshaken = true
+	if messageType != protocol.MessageHello {
+		return false, session.negotiate(protocol.VersionLegacy, 0)
+	}
+	version, err := binary.ReadUvarint(m)
+	if err != nil {
+		return true, err
+	}
+	features, err := binary.ReadUvarint(m)
+	if err != nil {
+		return true, err
+	}
+	if err = session.negotiate(version, features); err != nil {
+		return true, err
+	}
+	session.mux.Lock()
+	hello := protocol.CreateMessageHello(session.version, session.features)
+	session.mux.Unlock()
+	session.send(hello)
+	return true, nil
+}
+
+// negotiate uses the older of both protocol versions, and the features that both peers support.
+func (session *session) negotiate(version uint64, features uint64) error {
+	if version > protocol.Version {
+		version = protocol.Version
+	}
+	if min := session.ydb.minProtocolVersion; version < min {
+		return &closeError{protocol.CloseIncompatibleVersion, fmt.Sprintf("protocol version %d is not supported (minimum %d)", version, min)}
+	}
+	session.mux.Lock()
+	session.version = version
+	session.features = features & serverFeatures
+	session.mux.Unlock()
+	return nil
+}
+
+// sendError tells the client that something went wrong. Legacy clients are not notified.
+func (session *session) sendError(e protocol.Error) {
+	if session.supports(protocol.FeatureErrors) {
+		session.send(protocol.CreateMessageError(e))
+	}
+}
+
+// supports reports whether the client negotiated a protocol.Feature* flag.
+func (session *session) supports(feature uint64) bool {
+	session.mux.Lock()
+	defer session.mux.Unlock()
+	return session.features&feature != 0
+}
+
+// protocolVersion returns the negotiated protocol version.
+func (session *session) protocolVersion() uint64 {
+	session.mux.Lock()
+	defer session.mux.Unlock()
+	return session.version
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/jwmdev/ydb/protocol"
+)
+
+// TestHandshake tests that clients that send a hello use the negotiated protocol version,
+// and that clients without a hello use the legacy protocol.
+func TestHandshake(t *testing.T) {
+	dir := "_test_handshake"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	ydb := newTestYdb(t, dir)
+	defer ydb.Close()
+
+	s := newSession(ydb, 1)
+	conn := &recordingConn{}
+	s.add(conn)
+	hello := protocol.CreateMessageHello(protocol.Version+1, protocol.FeatureErrors|1<<10)
+	if err := readMessage(bytes.NewBuffer(hello), s); err != nil {
+		t.Fatal(err)
+	}
+	if err := readMessage(bytes.NewBuffer(protocol.CreateMessageSubscribe(7, protocol.SubDefinition{Roomname: testroom})), s); err != nil {
+		t.Fatal(err)
+	}
+	waitForDelivery(s)
+	if !conn.contains(protocol.CreateMessageHello(protocol.Version, protocol.FeatureErrors)) {
+		t.Error("expected the server to reply with the negotiated version and features")
+	}
+	if !conn.contains(protocol.CreateMessageHostUnconfirmedByClient(7, 0)) {
+		t.Error("expected the sub message to be confirmed")
+	}
+	subscribed := ydb.getRoom(testroom)
+	if !conn.contains(protocol.CreateMessageSubConf(protocol.Version, testroom, 0, uint64(subscribed.roomsessionid), subscribed.durability)) {
+		t.Error("expected the sub confirmation to carry the durability")
+	}
+	if err := readMessage(bytes.NewBuffer(hello), s); !isCloseError(err, protocol.CloseProtocolViolation) {
+		t.Errorf("expected a second hello to close the conn, got %v", err)
+	}
+
+	legacy := newSession(ydb, 2)
+	legacyConn := &recordingConn{}
+	legacy.add(legacyConn)
+	// legacy sub messages don't carry a confirmation number
+	sub := &bytes.Buffer{}
+	protocol.WriteUvarint(sub, protocol.MessageSub)
+	protocol.WriteUvarint(sub, 1)
+	protocol.WriteRoomname(sub, testroom)
+	protocol.WriteUvarint(sub, 0)
+	protocol.WriteUvarint(sub, 0)
+	if err := readMessage(sub, legacy); err != nil {
+		t.Fatal(err)
+	}
+	waitForDelivery(legacy)
+	room := ydb.getRoom(testroom)
+	if !legacyConn.contains(protocol.CreateMessageSubConf(protocol.VersionLegacy, testroom, 0, uint64(room.roomsessionid), room.durability)) {
+		t.Error("expected the legacy client to be subscribed")
+	}
+	if legacy.supports(protocol.FeatureErrors) {
+		t.Error("expected legacy clients not to receive errors")
+	}
+}
+
+// TestHandshakeRejectsOldClients tests that clients with an older protocol version than MinProtocolVersion are rejected.
+func TestHandshakeRejectsOldClients(t *testing.T) {
+	ydb := &Ydb{minProtocolVersion: protocol.Version}
+	for _, m := range [][]byte{
+		protocol.CreateMessageHello(protocol.VersionLegacy, 0),
+		protocol.CreateMessageConfirmation(0),
+	} {
+		s := newSession(ydb, 1)
+		if err := readMessage(bytes.NewBuffer(m), s); !isCloseError(err, protocol.CloseIncompatibleVersion) {
+			t.Errorf("expected the client to be rejected, got %v", err)
+		}
+	}
+}
+
+func isCloseError(err error, code int) bool {
+	cerr, ok := err.(*closeError)
+	return ok && cerr.code == code
+}
+
+// TestLegacyClientsReceiveNoErrors tests that errors are only sent to clients that negotiated protocol.FeatureErrors,
+// because legacy clients can't decode protocol.MessageError.
+func TestLegacyClientsReceiveNoErrors(t *testing.T) {
+	dir := "_test_legacy_errors"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	ydb := newTestYdb(t, dir)
+	defer ydb.Close()
+	ydb.fswriter.storage = &failingStorage{Storage: ydb.fswriter.storage, failures: maxWriteAttempts}
+	legacy := newSession(ydb, 1)
+	conn := &recordingConn{}
+	legacy.add(conn)
+	sub := &bytes.Buffer{}
+	protocol.WriteUvarint(sub, protocol.MessageSub)
+	protocol.WriteUvarint(sub, 1)
+	protocol.WriteRoomname(sub, testroom)
+	protocol.WriteUvarint(sub, 0)
+	protocol.WriteUvarint(sub, 0)
+	if err := readMessage(bytes.NewBuffer(sub.Bytes()), legacy); err != nil {
+		t.Fatal(err)
+	}
+	readMessage(bytes.NewBuffer(protocol.CreateMessageUpdate(testroom, 0, []byte{1})), legacy)
+	waitFor(t, "the room to be quarantined", func() bool {
+		room := ydb.lockRoom(testroom)
+		defer room.mux.Unlock()
+		return room.quarantined
+	})
+	// the room rejects all of these messages
+	for _, m := range [][]byte{
+		sub.Bytes(),
+		protocol.CreateMessageUpdate(testroom, 1, []byte{2}),
+		protocol.CreateMessageCompact(testroom, 2, 0, []byte{3}),
+		{100},
+	} {
+		readMessage(bytes.NewBuffer(m), legacy)
+	}
+	waitForDelivery(legacy)
+	conn.mux.Lock()
+	defer conn.mux.Unlock()
+	for _, m := range conn.messages {
+		if m[0] == protocol.MessageError {
+			t.Errorf("expected the legacy client not to receive errors, got %v", m)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/jwmdev/ydb/protocol"
+)
+
+func debug(s string) {
+	fmt.Println(s)
+}
+
+func debugMessageType(m string, buf []byte) {
+	mtype := "unknown"
+	switch buf[0] {
+	case protocol.MessageConfirmation:
+		mtype = "confirmation"
+	case protocol.MessageSub:
+		mtype = "subscription"
+	case protocol.MessageSubConf:
+		mtype = "subscription confirmation"
+	case protocol.MessageUpdate:
+		mtype = "update"
+	case protocol.MessageHostUnconfirmedByClient:
+		mtype = "host-unconfirmed-by-client"
+	case protocol.MessageConfirmedByHost:
+		mtype = "confirmed-by-host"
+	case protocol.MessageCompact:
+		mtype = "compact"
+	case protocol.MessageError:
+		mtype = "error"
+	case protocol.MessageHello:
+		mtype = "hello"
+	case protocol.MessageUnsub:
+		mtype = "unsubscription"
+	}
+	fmt.Printf("%s (type: %s, len: %d)\n", m, mtype, len(buf))
+}
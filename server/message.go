@@ -0,0 +1,225 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/jwmdev/ydb/protocol"
+)
+
+// errUnknownMessage is returned for unknown message types. The length of the message is unknown, so the rest of the
+// websocket message is skipped.
+var errUnknownMessage = errors.New("unknown message type")
+
+// readMessage reads the next message of m. Returns io.EOF if m is empty. Malformed messages fail with a closeError,
+// because the rest of m can't be decoded.
+func readMessage(m protocol.Message, session *session) (err error) {
+	messageType, err := binary.ReadUvarint(m)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil && err != errUnknownMessage {
+			if _, ok := err.(*closeError); !ok {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				err = &closeError{protocol.CloseProtocolViolation, fmt.Sprintf("malformed message of type %d: %s", messageType, err)}
+			}
+		}
+	}()
+	if !session.handshaken {
+		if handled, err := readFirstMessage(m, session, messageType); handled || err != nil {
+			return err
+		}
+	}
+	switch messageType {
+	case protocol.MessageSub:
+		debug("reading sub message")
+		err = readSubMessage(m, session)
+	case protocol.MessageUnsub:
+		debug("reading unsub message")
+		err = readUnsubMessage(m, session)
+	case protocol.MessageUpdate:
+		debug("reading update message")
+		err = readUpdateMessage(m, session)
+	case protocol.MessageConfirmation:
+		debug("reading conf message")
+		err = readConfirmationMessage(m, session)
+	case protocol.MessageCompact:
+		debug("reading compact message")
+		err = readCompactMessage(m, session)
+	case protocol.MessageHello:
+		err = &closeError{protocol.CloseProtocolViolation, "hello must be the first message"}
+	default:
+		debug(fmt.Sprintf("received unknown message type %d", messageType))
+		session.sendError(protocol.Error{Code: protocol.ErrorUnknownMessage, Text: fmt.Sprintf("unknown message type %d", messageType)})
+		err = errUnknownMessage
+	}
+	return err
+}
+
+// readSubMessage decodes all subscriptions before the session is subscribed, so that malformed messages have no effect.
+func readSubMessage(m protocol.Message, session *session) error {
+	version := session.protocolVersion()
+	var conf uint64
+	var err error
+	if version >= 1 {
+		if conf, err = binary.ReadUvarint(m); err != nil {
+			return err
+		}
+	}
+	nSubs, err := binary.ReadUvarint(m)
+	if err != nil {
+		return err
+	}
+	var subs []protocol.SubDefinition
+	var i uint64
+	for i = 0; i < nSubs; i++ {
+		var sub protocol.SubDefinition
+		if sub.Roomname, err = protocol.ReadRoomname(m); err != nil {
+			return err
+		}
+		if sub.Offset, err = binary.ReadUvarint(m); err != nil {
+			return err
+		}
+		if sub.Rsid, err = binary.ReadUvarint(m); err != nil {
+			return err
+		}
+		subs = append(subs, sub)
+	}
+	subConfBuf := &bytes.Buffer{}
+	protocol.WriteUvarint(subConfBuf, protocol.MessageSubConf)
+	protocol.WriteUvarint(subConfBuf, nSubs)
+	// rooms that can't be subscribed. The errors are sent after the sub confirmation
+	var failed []protocol.Error
+	for _, sub := range subs {
+		roomname := sub.Roomname
+		clientOffset := sub.Offset
+		clientRsid := sub.Rsid
+		protocol.WriteRoomname(subConfBuf, roomname)
+		room := session.ydb.lockRoom(roomname)
+		roomRsid := uint64(room.roomsessionid)
+		roomOffset := uint64(room.offset)
+		roomDurability := room.durability
+		room.mux.Unlock()
+		if roomRsid != clientRsid || roomOffset < clientOffset {
+			// in case of mismatch suggest the client to resync. TODO: Init Yjs sync here
+			clientOffset = 0
+			clientRsid = roomRsid
+		}
+		protocol.WriteUvarint(subConfBuf, clientOffset)
+		protocol.WriteUvarint(subConfBuf, clientRsid)
+		if version >= 1 {
+			// the guarantee that confirmedByHost gives for this room
+			protocol.WriteUvarint(subConfBuf, uint64(roomDurability))
+		}
+		if err := session.ydb.subscribeRoom(roomname, session, uint32(clientRsid), uint32(clientOffset)); err != nil {
+			e := roomError(roomname, conf, err)
+			// legacy sub messages don't carry a confirmation number
+			e.HasConf = version >= 1
+			failed = append(failed, e)
+		}
+	}
+	session.send(subConfBuf.Bytes())
+	for _, e := range failed {
+		session.sendError(e)
+	}
+	if version >= 1 {
+		session.sendHostUnconfirmedByClient(conf, 0)
+	}
+	return nil
+}
+
+// readUnsubMessage decodes all room names before the session is unsubscribed, so that malformed messages have no effect.
+func readUnsubMessage(m protocol.Message, session *session) error {
+	conf, err := binary.ReadUvarint(m)
+	if err != nil {
+		return err
+	}
+	n, err := binary.ReadUvarint(m)
+	if err != nil {
+		return err
+	}
+	var roomnames []protocol.Roomname
+	var i uint64
+	for i = 0; i < n; i++ {
+		roomname, err := protocol.ReadRoomname(m)
+		if err != nil {
+			return err
+		}
+		roomnames = append(roomnames, roomname)
+	}
+	for _, roomname := range roomnames {
+		session.ydb.unsubscribeRoom(roomname, session)
+	}
+	session.sendHostUnconfirmedByClient(conf, 0)
+	return nil
+}
+
+func readConfirmationMessage(m protocol.Message, session *session) error {
+	conf, err := binary.ReadUvarint(m)
+	if err != nil {
+		return err
+	}
+	session.serverConfirmation.clientConfirmed(conf)
+	return nil
+}
+
+func readCompactMessage(m protocol.Message, session *session) error {
+	confirmation, err := binary.ReadUvarint(m)
+	if err != nil {
+		return err
+	}
+	roomname, err := protocol.ReadRoomname(m)
+	if err != nil {
+		return err
+	}
+	baseOffset, err := binary.ReadUvarint(m)
+	if err != nil {
+		return err
+	}
+	bs, err := protocol.ReadPayload(m)
+	if err != nil {
+		return err
+	}
+	rejected := protocol.Error{Code: protocol.ErrorCompactionRejected, Roomname: roomname, HasConf: true, Conf: confirmation}
+	if !session.trusted {
+		debug(fmt.Sprintf("rejected compaction of room %s from untrusted session", roomname))
+		rejected.Text = "only clients that authenticate with the admin token may compact rooms"
+		session.sendError(rejected)
+		return nil
+	}
+	if err := session.ydb.compactRoom(roomname, session, confirmation, uint32(baseOffset), bs); err != nil {
+		debug(fmt.Sprintf("rejected compaction: %s", err))
+		if err == errRoomQuarantined || err == errRoomUnavailable {
+			session.sendError(roomError(roomname, confirmation, err))
+		} else {
+			rejected.Text = err.Error()
+			session.sendError(rejected)
+		}
+	}
+	return nil
+}
+
+func readUpdateMessage(m protocol.Message, session *session) error {
+	confirmation, err := binary.ReadUvarint(m)
+	if err != nil {
+		return err
+	}
+	roomname, err := protocol.ReadRoomname(m)
+	if err != nil {
+		return err
+	}
+	bs, err := protocol.ReadPayload(m)
+	if err != nil {
+		return err
+	}
+	if err := session.ydb.updateRoom(roomname, session, confirmation, bs); err != nil {
+		session.sendError(roomError(roomname, confirmation, err))
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jwmdev/ydb/protocol"
+	"github.com/jwmdev/ydb/storage"
+)
+
+// TestReadMalformedMessage tests that malformed messages close the conn, and that they don't modify rooms.
+func TestReadMalformedMessage(t *testing.T) {
+	dir := "_test_malformed"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	ydb := newTestYdb(t, dir)
+	defer ydb.Close()
+
+	update := protocol.CreateMessageUpdate(testroom, 0, []byte{1, 2, 3})
+	hugePayload := &bytes.Buffer{}
+	protocol.WriteUvarint(hugePayload, protocol.MessageUpdate)
+	protocol.WriteUvarint(hugePayload, 0)
+	protocol.WriteRoomname(hugePayload, testroom)
+	protocol.WriteUvarint(hugePayload, math.MaxUint64)
+	messages := map[string][]byte{
+		"truncated update":  update[:len(update)-1],
+		"truncated varint":  {protocol.MessageUpdate, 0x80},
+		"missing fields":    {protocol.MessageUpdate},
+		"huge payload":      hugePayload.Bytes(),
+		"long room name":    protocol.CreateMessageUpdate(protocol.Roomname(strings.Repeat("x", protocol.MaxRoomnameLength+1)), 0, nil),
+		"truncated sub":     protocol.CreateMessageSubscribe(0, protocol.SubDefinition{Roomname: testroom}, protocol.SubDefinition{Roomname: "b"})[:8],
+		"truncated compact": protocol.CreateMessageCompact(testroom, 0, 0, []byte{1})[:5],
+		"truncated conf":    {protocol.MessageConfirmation},
+		"truncated unsub":   protocol.CreateMessageUnsubscribe(0, testroom)[:4],
+		"second hello":      append(protocol.CreateMessageHello(protocol.Version, 0), protocol.CreateMessageHello(protocol.Version, 0)...),
+	}
+	for name, m := range messages {
+		t.Run(name, func(t *testing.T) {
+			s := newSession(ydb, 1)
+			s.negotiate(protocol.Version, 0)
+			s.handshaken = true
+			buf := bytes.NewBuffer(m)
+			var err error
+			for err == nil {
+				err = readMessage(buf, s)
+			}
+			if !isCloseError(err, protocol.CloseProtocolViolation) {
+				t.Errorf("expected a protocol violation, got %v", err)
+			}
+		})
+	}
+	if room := ydb.getRoom(testroom); room.offset != 0 {
+		t.Errorf("expected malformed messages not to modify the room, got offset %d", room.offset)
+	}
+
+	// unknown messages end the websocket message, but the conn stays open
+	for _, m := range [][]byte{{100, 1, 2}, protocol.CreateMessageConfirmedByHost(testroom, 0)} {
+		s := newSession(ydb, 2)
+		s.negotiate(protocol.Version, protocol.FeatureErrors)
+		s.handshaken = true
+		conn := &recordingConn{}
+		s.add(conn)
+		if err := readMessage(bytes.NewBuffer(m), s); err != errUnknownMessage {
+			t.Errorf("expected message type %d to be unknown, got %v", m[0], err)
+		}
+		waitForDelivery(s)
+		expected := protocol.Error{Code: protocol.ErrorUnknownMessage, Text: fmt.Sprintf("unknown message type %d", m[0])}
+		if !conn.contains(protocol.CreateMessageError(expected)) {
+			t.Errorf("expected an error for message type %d", m[0])
+		}
+	}
+
+	s := newSession(ydb, 3)
+	buf := bytes.NewBuffer(append(update, protocol.CreateMessageConfirmation(0)...))
+	for i := 0; i < 2; i++ {
+		if err := readMessage(buf, s); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+	}
+	if err := readMessage(buf, s); err != io.EOF {
+		t.Errorf("expected io.EOF after the last message, got %v", err)
+	}
+}
+
+// discardingStorage drops appended data, so that rooms don't grow while fuzzing.
+type discardingStorage struct {
+	storage.Storage
+}
+
+func (discardingStorage) Append(roomname protocol.Roomname, data []byte) error {
+	return nil
+}
+
+// FuzzReadMessage reads arbitrary messages from a client. Reading must not panic, deadlock, or allocate much more
+// memory than the message size.
+func FuzzReadMessage(f *testing.F) {
+	for _, m := range [][]byte{
+		protocol.CreateMessageHello(protocol.Version, protocol.FeatureErrors),
+		protocol.CreateMessageSubscribe(0, protocol.SubDefinition{Roomname: testroom, Offset: 3, Rsid: 42}),
+		protocol.CreateMessageUpdate(testroom, 1, []byte{1, 2, 3}),
+		protocol.CreateMessageConfirmation(2),
+		protocol.CreateMessageCompact(testroom, 3, 3, []byte{4}),
+		protocol.CreateMessageUnsubscribe(4, testroom),
+		append(protocol.CreateMessageHello(protocol.Version, 0), protocol.CreateMessageUpdate(testroom, 0, []byte{1})...),
+		{protocol.MessageSub, 1, 4, 'r', 'o', 'o', 'm', 0, 0},
+	} {
+		f.Add(m)
+	}
+	ydb, err := New(Options{Storage: storage.KindMemory})
+	if err != nil {
+		f.Fatal(err)
+	}
+	defer ydb.Close()
+	ydb.fswriter.storage = discardingStorage{ydb.fswriter.storage}
+	var sessionid uint64
+	f.Fuzz(func(t *testing.T, m []byte) {
+		sessionid++
+		// without a conn, the messages of the session are dropped
+		s := newSession(ydb, sessionid)
+		// write tasks of previous messages must not be part of the allocation
+		waitUntil(context.Background(), ydb.roomsFlushed)
+		var before, after runtime.MemStats
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			runtime.ReadMemStats(&before)
+			buf := bytes.NewBuffer(m)
+			for readMessage(buf, s) == nil {
+			}
+			runtime.ReadMemStats(&after)
+		}()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatal("reading the message did not finish")
+		}
+		// rooms that are created by the message are part of the allocation. The margin covers allocations of other
+		// goroutines, but not a payload of protocol.MaxMessageSize that a small message announces
+		if allocated, limit := after.TotalAlloc-before.TotalAlloc, uint64(protocol.MaxMessageSize/2+1024*len(m)); allocated > limit {
+			t.Errorf("reading a message of %d bytes allocated %d bytes", len(m), allocated)
+		}
+	})
+}
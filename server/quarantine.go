@@ -0,0 +1,115 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jwmdev/ydb/protocol"
+)
+
+// Rooms that fail to persist are retried up to maxWriteAttempts times, waiting writeRetryDelay before the first retry
+// and doubling the delay after each failure. Then the room is quarantined: it rejects updates and subscriptions until
+// the server restarts, and its subscribers receive a protocol.MessageError if they support protocol.FeatureErrors.
+// Failed reads of the content that a pending subscriber catches up with are retried the same way. Then only the
+// subscriber receives an error.
+const (
+	maxWriteAttempts = 3
+	writeRetryDelay  = 100 * time.Millisecond
+)
+
+var (
+	// sent to clients. The cause is only logged, as it may contain paths of the server
+	errRoomQuarantined = errors.New("room is quarantined after repeated storage failures")
+	errRoomUnavailable = errors.New("room is temporarily unavailable")
+)
+
+// writeFailed handles a failed attempt to persist pendingWrites, which start at offset base of the room.
+// Returns true if the write is retried. Then the room stays registered.
+// Expects room.mux to be locked.
+func (fswriter *fswriter) writeFailed(roomname protocol.Roomname, room *room, pendingWrites []byte, base uint32, err error) (retry bool) {
+	fmt.Printf("ydb error: unable to persist room %s: %s\n", roomname, err)
+	// remove a partial append, so that the retry does not duplicate data
+	if err := fswriter.storage.Truncate(roomname, base); err != nil {
+		debug(fmt.Sprintf("fswriter: unable to truncate room %s: %s", roomname, err))
+	}
+	room.writeFailures++
+	if room.writeFailures >= maxWriteAttempts {
+		fswriter.quarantineRoom(roomname, room)
+		return false
+	}
+	room.pendingWrites = append(pendingWrites, room.pendingWrites...)
+	delay := writeRetryDelay << uint(room.writeFailures-1)
+	time.AfterFunc(delay, func() {
+		fswriter.registerRoomUpdate(room, roomname)
+	})
+	return true
+}
+
+// readFailed handles a failed attempt to send the content of a room to a pending subscriber. Returns true if the
+// attempt is retried. Otherwise the session receives a protocol.ErrorRoomUnavailable and is not subscribed.
+// Expects room.mux to be locked.
+func (fswriter *fswriter) readFailed(roomname protocol.Roomname, sub *pendingSub, err error) (retry bool) {
+	fmt.Printf("ydb error: unable to read room %s: %s\n", roomname, err)
+	sub.readFailures++
+	if sub.readFailures < maxWriteAttempts {
+		delay := writeRetryDelay << uint(sub.readFailures-1)
+		time.AfterFunc(delay, func() {
+			// register the room, so that the fswriter serves the pending subs
+			fswriter.ydb.modifyRoom(roomname, func(room *room) bool {
+				return len(room.pendingSubs) > 0
+			})
+		})
+		return true
+	}
+	sub.session.sendError(protocol.Error{Code: protocol.ErrorRoomUnavailable, Roomname: roomname, Text: errRoomUnavailable.Error()})
+	return false
+}
+
+// rehydrationFailed counts a failed rehydration of a tiered room. The room is rehydrated again when it is accessed.
+// Expects room.mux to be locked.
+func (fswriter *fswriter) rehydrationFailed(roomname protocol.Roomname, room *room, err error) error {
+	fmt.Printf("ydb error: unable to rehydrate room %s: %s\n", roomname, err)
+	room.writeFailures++
+	if room.writeFailures >= maxWriteAttempts {
+		fswriter.quarantineRoom(roomname, room)
+		return errRoomQuarantined
+	}
+	return errRoomUnavailable
+}
+
+// quarantineRoom stops persisting the room and unsubscribes all subscribers with an error.
+// Data that was not persisted is dropped. It was not confirmed to clients, unless the room uses protocol.DurabilityMemory.
+// Expects room.mux to be locked.
+func (fswriter *fswriter) quarantineRoom(roomname protocol.Roomname, room *room) {
+	fmt.Printf("ydb error: quarantined room %s\n", roomname)
+	room.quarantined = true
+	room.pendingWrites = nil
+	m := prepareMessage(protocol.CreateMessageError(protocol.Error{
+		Code:     protocol.ErrorRoomQuarantined,
+		Roomname: roomname,
+		Text:     errRoomQuarantined.Error(),
+	}))
+	for _, s := range room.subs {
+		if s.supports(protocol.FeatureErrors) {
+			s.enqueue(m)
+		}
+	}
+	for _, sub := range room.pendingSubs {
+		if sub.session.supports(protocol.FeatureErrors) {
+			sub.session.enqueue(m)
+		}
+	}
+	room.subs = nil
+	room.pendingSubs = nil
+}
+
+// roomError describes why the message with confirmation number conf could not access the room.
+// err is errRoomQuarantined or errRoomUnavailable.
+func roomError(roomname protocol.Roomname, conf uint64, err error) protocol.Error {
+	code := protocol.ErrorRoomUnavailable
+	if err == errRoomQuarantined {
+		code = protocol.ErrorRoomQuarantined
+	}
+	return protocol.Error{Code: code, Roomname: roomname, HasConf: true, Conf: conf, Text: err.Error()}
+}
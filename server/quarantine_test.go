@@ -0,0 +1,149 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/jwmdev/ydb/protocol"
+	"github.com/jwmdev/ydb/storage"
+)
+
+// failingStorage fails the next failures appends and the next readFailures reads.
+type failingStorage struct {
+	storage.Storage
+	failures     int32
+	readFailures int32
+}
+
+func (s *failingStorage) ReadFrom(roomname protocol.Roomname, offset uint32) (io.ReadCloser, error) {
+	if atomic.AddInt32(&s.readFailures, -1) >= 0 {
+		return nil, errors.New("i/o error")
+	}
+	return s.Storage.ReadFrom(roomname, offset)
+}
+
+func (s *failingStorage) Append(roomname protocol.Roomname, data []byte) error {
+	if atomic.AddInt32(&s.failures, -1) >= 0 {
+		return errors.New("disk full")
+	}
+	return s.Storage.Append(roomname, data)
+}
+
+// TestWriteRetry tests that failed writes are retried, and confirmed once they are persisted.
+func TestWriteRetry(t *testing.T) {
+	dir := "_test_write_retry"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	ydb := newTestYdb(t, dir)
+	defer ydb.Close()
+	store := &failingStorage{Storage: ydb.fswriter.storage, failures: maxWriteAttempts - 1}
+	ydb.fswriter.storage = store
+	subscriber := newSession(ydb, 1)
+	conn := &recordingConn{}
+	subscriber.add(conn)
+	ydb.subscribeRoom(testroom, subscriber, 0, 0)
+	if err := ydb.updateRoom(testroom, newSession(ydb, 2), 0, []byte{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the update to be confirmed", func() bool {
+		return conn.contains(protocol.CreateMessageConfirmedByHost(testroom, 3))
+	})
+	r, _ := store.ReadFrom(testroom, 0)
+	data, _ := ioutil.ReadAll(r)
+	r.Close()
+	if !bytes.Equal(data, []byte{1, 2, 3}) {
+		t.Errorf("expected persisted content [1 2 3], got %v", data)
+	}
+}
+
+// TestQuarantine tests that a room that keeps failing rejects updates, and that its subscribers receive an error.
+func TestQuarantine(t *testing.T) {
+	dir := "_test_quarantine"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	ydb := newTestYdb(t, dir)
+	defer ydb.Close()
+	ydb.fswriter.storage = &failingStorage{Storage: ydb.fswriter.storage, failures: maxWriteAttempts}
+	subscriber := newSession(ydb, 1)
+	subscriber.negotiate(protocol.Version, protocol.FeatureErrors)
+	conn := &recordingConn{}
+	subscriber.add(conn)
+	ydb.subscribeRoom(testroom, subscriber, 0, 0)
+	writer := newSession(ydb, 2)
+	ydb.updateRoom(testroom, writer, 0, []byte{1, 2, 3})
+	waitFor(t, "the subscriber to receive an error", func() bool {
+		return conn.contains(protocol.CreateMessageError(protocol.Error{
+			Code:     protocol.ErrorRoomQuarantined,
+			Roomname: testroom,
+			Text:     errRoomQuarantined.Error(),
+		}))
+	})
+	if conn.contains(protocol.CreateMessageConfirmedByHost(testroom, 3)) {
+		t.Error("expected the update not to be confirmed")
+	}
+	writer.negotiate(protocol.Version, protocol.FeatureErrors)
+	writer.handshaken = true
+	writerConn := &recordingConn{}
+	writer.add(writerConn)
+	readMessage(bytes.NewBuffer(protocol.CreateMessageUpdate(testroom, 1, []byte{4})), writer)
+	waitFor(t, "the writer to receive an error", func() bool {
+		return writerConn.contains(protocol.CreateMessageError(roomError(testroom, 1, errRoomQuarantined)))
+	})
+	if err := ydb.updateRoom(testroom, writer, 2, []byte{4}); err != errRoomQuarantined {
+		t.Errorf("expected the quarantined room to reject updates, got %v", err)
+	}
+	if err := ydb.subscribeRoom(testroom, newSession(ydb, 3), 0, 0); err != errRoomQuarantined {
+		t.Errorf("expected the quarantined room to reject subscriptions, got %v", err)
+	}
+}
+
+// TestReadRetry tests that subscribers are only subscribed after the content of the room was read, and that they
+// receive an error if reading keeps failing.
+func TestReadRetry(t *testing.T) {
+	dir := "_test_read_retry"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	ydb := newTestYdb(t, dir)
+	defer ydb.Close()
+	store := &failingStorage{Storage: ydb.fswriter.storage}
+	ydb.fswriter.storage = store
+	ydb.updateRoom(testroom, newSession(ydb, 1), 0, []byte{1, 2, 3})
+	waitForRoomPersisted(ydb, testroom)
+
+	atomic.StoreInt32(&store.readFailures, maxWriteAttempts-1)
+	subscriber := newSession(ydb, 2)
+	conn := &recordingConn{}
+	subscriber.add(conn)
+	ydb.subscribeRoom(testroom, subscriber, 0, 0)
+	waitFor(t, "the subscriber to catch up", func() bool {
+		return conn.contains(protocol.CreateMessageConfirmedByHost(testroom, 3))
+	})
+	if !conn.contains(protocol.CreateMessageUpdate(testroom, 3, []byte{1, 2, 3})) {
+		t.Error("expected the subscriber to receive the content")
+	}
+
+	atomic.StoreInt32(&store.readFailures, maxWriteAttempts)
+	failing := newSession(ydb, 3)
+	failing.negotiate(protocol.Version, protocol.FeatureErrors)
+	failingConn := &recordingConn{}
+	failing.add(failingConn)
+	ydb.subscribeRoom(testroom, failing, 0, 0)
+	waitFor(t, "the subscriber to receive an error", func() bool {
+		return failingConn.contains(protocol.CreateMessageError(protocol.Error{
+			Code:     protocol.ErrorRoomUnavailable,
+			Roomname: testroom,
+			Text:     errRoomUnavailable.Error(),
+		}))
+	})
+	room := ydb.lockRoom(testroom)
+	subscribed := room.hasSession(failing) || len(room.pendingSubs) > 0
+	room.mux.Unlock()
+	if subscribed {
+		t.Error("expected the session not to be subscribed")
+	}
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jwmdev/ydb/protocol"
+)
+
+type pendingWrite struct {
+	data    []byte
+	session *session
+	conf    uint64
+}
+
+type room struct {
+	mux sync.Mutex
+	// held by the write task while it persists the room without room.mux, and by others that write the
+	// content of the room (e.g. compaction). Acquired after room.mux
+	writeMux      sync.Mutex
+	registered    bool
+	pendingWrites []byte
+	subs          []*session
+	pendingSubs   []pendingSub
+	roomsessionid uint32
+	offset        uint32
+	durability    protocol.Durability
+	created       time.Time
+	modified      time.Time
+	// whether the persisted meta is marked as unclean
+	metaDirty bool
+	// whether the content was moved to the blob store
+	tiered bool
+	// consecutive failures to persist or rehydrate the room (see quarantine.go)
+	writeFailures int
+	// whether the room rejects updates and subscriptions after repeated storage failures
+	quarantined bool
+	// position in the lru of the stripe. Protected by the lru mux
+	lruElement *list.Element
+	// whether the room was removed from ydb.rooms (see roomcache.go)
+	evicted bool
+}
+
+func (ydb *Ydb) newRoom() *room {
+	return &room{
+		subs:          nil,
+		roomsessionid: ydb.genUint32(),
+		offset:        0,
+	}
+}
+
+// modifyRoom calls f with the locked room, and registers the room in fswriter if f returns true.
+// Returns an error that can be sent to clients if the room can't be accessed.
+func (ydb *Ydb) modifyRoom(roomname protocol.Roomname, f func(room *room) (modified bool)) error {
+	var register bool
+	room := ydb.lockRoom(roomname)
+	if room.quarantined {
+		room.mux.Unlock()
+		return errRoomQuarantined
+	}
+	if room.tiered {
+		if err := ydb.fswriter.rehydrateRoom(roomname, room); err != nil {
+			err = ydb.fswriter.rehydrationFailed(roomname, room, err)
+			room.mux.Unlock()
+			return err
+		}
+	}
+	// try to clean up subs
+	needsCleanup := false
+	for _, s := range room.subs {
+		if s.conn == nil {
+			needsCleanup = true
+			break
+		}
+	}
+	if needsCleanup {
+		var newSubs []*session
+		for _, s := range room.subs {
+			if s.conn != nil {
+				newSubs = append(newSubs, s)
+			}
+		}
+		room.subs = newSubs
+	}
+
+	modified := f(room)
+	if room.registered == false && modified {
+		register = true
+		room.registered = true
+	}
+	room.mux.Unlock()
+	if register {
+		ydb.fswriter.registerRoomUpdate(room, roomname)
+	}
+	return nil
+}
+
+// update in-memory buffer of writable data. Registers in fswriter if new data is available.
+// Writes to buffer until fswriter owns the buffer.
+func (ydb *Ydb) updateRoom(roomname protocol.Roomname, session *session, clientConf uint64, bs []byte) error {
+	debug("trying to update room")
+	err := ydb.modifyRoom(roomname, func(room *room) bool {
+		debug("updating room")
+		room.pendingWrites = append(room.pendingWrites, bs...)
+		room.offset += uint32(len(bs))
+		debug(fmt.Sprintf("updating room .. number of subs: %d", len(room.subs)))
+		if len(bs) > 0 && len(room.subs) > 0 {
+			// the update does not depend on the recipient, so it is framed once
+			update := prepareUpdate(roomname, bs, uint64(room.offset))
+			for _, s := range room.subs {
+				if s != session {
+					s.enqueue(update)
+				}
+			}
+		}
+		debug("updating room .. wrote update to all sessions but sender")
+		session.sendHostUnconfirmedByClient(clientConf, uint64(room.offset))
+		debug("updating room .. sent conf to client")
+		if room.durability == protocol.DurabilityMemory {
+			room.sendConfirmedByHost(roomname, room.offset)
+		}
+		return true
+	})
+	debug("done updating room")
+	return err
+}
+
+// sendConfirmedByHost confirms offset to all subscribers.
+// Expects room.mux to be locked.
+func (room *room) sendConfirmedByHost(roomname protocol.Roomname, offset uint32) {
+	if len(room.subs) == 0 {
+		return
+	}
+	conf := prepareMessage(protocol.CreateMessageConfirmedByHost(roomname, uint64(offset)))
+	for _, s := range room.subs {
+		s.enqueue(conf)
+	}
+}
+
+type pendingSub struct {
+	session *session
+	offset  uint32
+	// consecutive failures to read the room content for the session (see fswriter.readFailed)
+	readFailures int
+}
+
+func (room *room) hasSession(session *session) bool {
+	for _, s := range room.subs {
+		if s == session {
+			return true
+		}
+	}
+	return false
+}
+
+func (ydb *Ydb) subscribeRoom(roomname protocol.Roomname, session *session, roomsessionid uint32, offset uint32) error {
+	return ydb.modifyRoom(roomname, func(room *room) bool {
+		if !room.hasSession(session) {
+			if room.offset != offset {
+				room.pendingSubs = append(room.pendingSubs, pendingSub{session: session, offset: offset})
+				return true
+			}
+			room.subs = append(room.subs, session)
+			// session.sendConfirmedByHost(roomname, uint64(offset))
+		}
+		return false // whether room data needs to access fswriter
+	})
+}
+
+// unsubscribeRoom removes the session from the subscribers of a room. The room is evicted once it is idle, so that
+// sessions that open many rooms don't keep them cached. Rooms that still have data to persist are left to evictIdleRooms.
+// Unlike subscribeRoom, this succeeds for quarantined and tiered rooms.
+func (ydb *Ydb) unsubscribeRoom(roomname protocol.Roomname, s *session) {
+	room, ok := ydb.rooms.lookup(roomname)
+	if !ok {
+		// subscribed rooms are not idle, so they are never evicted
+		return
+	}
+	room.mux.Lock()
+	defer room.mux.Unlock()
+	if room.evicted {
+		return
+	}
+	var subs []*session
+	for _, sub := range room.subs {
+		if sub != s && sub.conn != nil {
+			subs = append(subs, sub)
+		}
+	}
+	room.subs = subs
+	var pendingSubs []pendingSub
+	for _, sub := range room.pendingSubs {
+		if sub.session != s {
+			pendingSubs = append(pendingSubs, sub)
+		}
+	}
+	room.pendingSubs = pendingSubs
+	s.mux.Lock()
+	// the room must not continue to send its content, or resubscribe the session (see resubscribe)
+	delete(s.catchups, roomname)
+	delete(s.resyncing, roomname)
+	s.mux.Unlock()
+	if room.idle() {
+		ydb.rooms.stripe(roomname).lru.remove(room)
+		ydb.evictRoom(roomname, room)
+	}
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jwmdev/ydb/protocol"
+	"github.com/jwmdev/ydb/storage"
+)
+
+// Rooms are cached in Ydb.rooms while they are used. If the number of cached rooms exceeds Ydb.maxRooms, idle rooms
+// are evicted. Each stripe orders its rooms by their last access, so the evicted rooms are the least recently used
+// rooms of their stripe. An evicted room is reloaded from the room index by getRoom,
+// so it keeps its offset and roomsessionid. Rooms are also evicted when their last subscriber unsubscribes (see unsubscribeRoom).
+// A room may be evicted after getRoom returned it. Use lockRoom to lock a room that is still cached.
+
+// roomLRU orders the cached rooms by their last access.
+type roomLRU struct {
+	mux sync.Mutex
+	// of *lruEntry, most recently used first
+	list *list.List
+}
+
+type lruEntry struct {
+	roomname protocol.Roomname
+	room     *room
+}
+
+func (lru *roomLRU) init() {
+	lru.list = list.New()
+}
+
+// add a room that was just created. Expects room.mux to be locked.
+func (lru *roomLRU) add(roomname protocol.Roomname, room *room) {
+	lru.mux.Lock()
+	room.lruElement = lru.list.PushFront(&lruEntry{roomname, room})
+	lru.mux.Unlock()
+}
+
+// touch marks a room as recently used.
+func (lru *roomLRU) touch(room *room) {
+	lru.mux.Lock()
+	if room.lruElement != nil {
+		lru.list.MoveToFront(room.lruElement)
+	}
+	lru.mux.Unlock()
+}
+
+// remove a room from the lru, so that it is not evicted again. Expects room.mux to be locked.
+func (lru *roomLRU) remove(room *room) {
+	lru.mux.Lock()
+	if room.lruElement != nil {
+		lru.list.Remove(room.lruElement)
+		room.lruElement = nil
+	}
+	lru.mux.Unlock()
+}
+
+// idle rooms have nothing to persist and nobody to notify.
+// Expects room.mux to be locked.
+func (room *room) idle() bool {
+	// quarantined rooms stay cached, so that they are not loaded again from the storage
+	if room.registered || len(room.pendingWrites) > 0 || len(room.pendingSubs) > 0 || room.quarantined {
+		return false
+	}
+	for _, s := range room.subs {
+		if s.conn != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// lockRoom returns the cached room with room.mux locked.
+func (ydb *Ydb) lockRoom(roomname protocol.Roomname) *room {
+	room := ydb.getRoom(roomname)
+	room.mux.Lock()
+	for room.evicted {
+		room.mux.Unlock()
+		room = ydb.getRoom(roomname)
+		room.mux.Lock()
+	}
+	return room
+}
+
+// evictIdleRooms evicts idle rooms until at most ydb.maxRooms rooms are cached. The stripe of the room that was just
+// created is tried first, then the other stripes, starting where the last eviction stopped. keep is never evicted,
+// so that the room that getRoom just created is not evicted before it is used.
+func (ydb *Ydb) evictIdleRooms(stripe *roomStripe, keep *room) (evicted int) {
+	if ydb.maxRooms <= 0 {
+		return
+	}
+	excess := ydb.rooms.len() - ydb.maxRooms
+	if excess <= 0 {
+		return
+	}
+	evicted = ydb.evictFromStripe(stripe, keep, excess)
+	n := len(ydb.rooms.stripes)
+	next := int(atomic.AddUint32(&ydb.rooms.evictionCursor, 1))
+	for i := 0; i < n && evicted < excess; i++ {
+		if s := &ydb.rooms.stripes[(next+i)%n]; s != stripe {
+			evicted += ydb.evictFromStripe(s, keep, excess-evicted)
+		}
+	}
+	return evicted
+}
+
+// evictFromStripe evicts at most max of the least recently used idle rooms of a stripe. Rooms that are locked are
+// skipped, so eviction never waits for the fswriter.
+// Victims stay locked while the stripe is locked, so cached rooms must not be locked while a stripe is locked.
+func (ydb *Ydb) evictFromStripe(stripe *roomStripe, keep *room, max int) int {
+	var victims []*lruEntry
+	lru := &stripe.lru
+	lru.mux.Lock()
+	for e := lru.list.Back(); e != nil && len(victims) < max; {
+		prev := e.Prev()
+		entry := e.Value.(*lruEntry)
+		if entry.room != keep && entry.room.mux.TryLock() {
+			if entry.room.idle() {
+				lru.list.Remove(e)
+				entry.room.lruElement = nil
+				victims = append(victims, entry)
+			} else {
+				entry.room.mux.Unlock()
+			}
+		}
+		e = prev
+	}
+	lru.mux.Unlock()
+	for _, victim := range victims {
+		ydb.evictRoom(victim.roomname, victim.room)
+		victim.room.mux.Unlock()
+	}
+	return len(victims)
+}
+
+// evictRoom removes an idle room from ydb.rooms. The room must have been removed from the lru.
+// Expects room.mux to be locked.
+func (ydb *Ydb) evictRoom(roomname protocol.Roomname, room *room) {
+	ydb.fswriter.closeRoomMeta(roomname, room)
+	if _, ok := ydb.fswriter.index.get(roomname); !ok {
+		// nothing was persisted yet. Remember the roomsessionid that clients already know
+		ydb.fswriter.index.set(storage.RoomMeta{
+			Name:     roomname,
+			Rsid:     room.roomsessionid,
+			Offset:   room.offset,
+			Created:  room.created,
+			Modified: room.modified,
+			Clean:    true,
+		})
+	}
+	room.evicted = true
+	ydb.rooms.remove(roomname, room)
+}
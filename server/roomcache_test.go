@@ -0,0 +1,104 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/jwmdev/ydb/protocol"
+)
+
+// TestRoomEviction tests that idle rooms are evicted, and that they keep offset and rsid when they are reloaded.
+func TestRoomEviction(t *testing.T) {
+	dir := "_test_eviction"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	ydb := newTestYdb(t, dir)
+	defer ydb.Close()
+	ydb.maxRooms = 2
+	writer := newSession(ydb, 1)
+	subscriber := newSession(ydb, 2)
+	subscriber.add(&recordingConn{})
+
+	ydb.updateRoom("a", writer, 0, []byte{1, 2, 3})
+	waitForRoomPersisted(ydb, "a")
+	rsid := ydb.getRoom("a").roomsessionid
+	ydb.subscribeRoom("b", subscriber, 0, 0)
+	ydb.getRoom("c")
+	_, aCached := ydb.rooms.lookup("a")
+	_, bCached := ydb.rooms.lookup("b")
+	n := ydb.rooms.len()
+	if aCached || !bCached || n != 2 {
+		t.Errorf("expected idle room a to be evicted and subscribed room b to be cached, got %d rooms (a cached: %v, b cached: %v)", n, aCached, bCached)
+	}
+	room := ydb.getRoom("a")
+	if room.offset != 3 || room.roomsessionid != rsid {
+		t.Errorf("expected reloaded room to have offset 3 and rsid %d, got offset %d and rsid %d", rsid, room.offset, room.roomsessionid)
+	}
+	// rooms of different stripes count towards the same cap
+	for i := 0; i < 2*roomStripes; i++ {
+		ydb.getRoom(protocol.Roomname(fmt.Sprintf("idle%d", i)))
+	}
+	if n := ydb.rooms.len(); n != ydb.maxRooms {
+		t.Errorf("expected %d cached rooms, got %d", ydb.maxRooms, n)
+	}
+}
+
+// TestUnsubscribe tests that unsubscribed sessions don't receive updates, and that the room is evicted once
+// nobody is subscribed.
+func TestUnsubscribe(t *testing.T) {
+	dir := "_test_unsubscribe"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	ydb := newTestYdb(t, dir)
+	defer ydb.Close()
+	leaving := newSession(ydb, 1)
+	leaving.negotiate(protocol.Version, protocol.FeatureErrors|protocol.FeatureUnsub)
+	leaving.handshaken = true
+	leavingConn := &recordingConn{}
+	leaving.add(leavingConn)
+	staying := newSession(ydb, 2)
+	stayingConn := &recordingConn{}
+	staying.add(stayingConn)
+	ydb.subscribeRoom(testroom, leaving, 0, 0)
+	ydb.subscribeRoom(testroom, staying, 0, 0)
+
+	if err := readMessage(bytes.NewBuffer(protocol.CreateMessageUnsubscribe(5, testroom)), leaving); err != nil {
+		t.Fatal(err)
+	}
+	ydb.updateRoom(testroom, newSession(ydb, 3), 0, []byte{1, 2, 3})
+	waitForRoomPersisted(ydb, testroom)
+	waitForDelivery(leaving)
+	waitForDelivery(staying)
+	if !leavingConn.contains(protocol.CreateMessageHostUnconfirmedByClient(5, 0)) {
+		t.Error("expected the unsub message to be confirmed")
+	}
+	update := protocol.CreateMessageUpdate(testroom, 3, []byte{1, 2, 3})
+	if leavingConn.contains(update) || !stayingConn.contains(update) {
+		t.Error("expected only the subscribed session to receive the update")
+	}
+	if _, cached := ydb.rooms.lookup(testroom); !cached {
+		t.Error("expected the room to stay cached while a session is subscribed")
+	}
+
+	// a session that is catching up is removed from the pending subs
+	catchingUp := newSession(ydb, 4)
+	catchingUp.add(&recordingConn{})
+	ydb.subscribeRoom(testroom, catchingUp, 0, 0)
+	ydb.unsubscribeRoom(testroom, catchingUp)
+	// the room is not idle before the fswriter is done with it
+	waitForRoomPersisted(ydb, testroom)
+	if room, _ := ydb.rooms.lookup(testroom); room.hasSession(catchingUp) {
+		t.Error("expected the unsubscribed session not to catch up")
+	}
+	ydb.unsubscribeRoom(testroom, staying)
+	if _, cached := ydb.rooms.lookup(testroom); cached {
+		t.Error("expected the room to be evicted once nobody is subscribed")
+	}
+	room := ydb.getRoom(testroom)
+	if room.offset != 3 || len(room.subs) != 0 {
+		t.Errorf("expected the reloaded room to have offset 3 and no subscribers, got offset %d and %d subscribers", room.offset, len(room.subs))
+	}
+	ydb.unsubscribeRoom("unknown", staying)
+}
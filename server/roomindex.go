@@ -0,0 +1,158 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jwmdev/ydb/protocol"
+	"github.com/jwmdev/ydb/storage"
+)
+
+const indexFilename = storage.IndexFilename
+
+// roomIndex holds the meta of all persisted rooms, so that rooms are initialized without accessing the storage.
+// It is updated whenever a room meta is written (see fswriter.saveRoomMeta).
+// The index is saved when Ydb is closed cleanly and loaded when Ydb starts. Otherwise it is rebuilt from the storage.
+type roomIndex struct {
+	mux   sync.RWMutex
+	rooms map[protocol.Roomname]storage.RoomMeta
+	// empty if the index is not persisted
+	path string
+}
+
+func newRoomIndex(path string) *roomIndex {
+	return &roomIndex{
+		rooms: make(map[protocol.Roomname]storage.RoomMeta),
+		path:  path,
+	}
+}
+
+func (index *roomIndex) get(roomname protocol.Roomname) (meta storage.RoomMeta, ok bool) {
+	index.mux.RLock()
+	meta, ok = index.rooms[roomname]
+	index.mux.RUnlock()
+	return
+}
+
+func (index *roomIndex) set(meta storage.RoomMeta) {
+	index.mux.Lock()
+	index.rooms[meta.Name] = meta
+	index.mux.Unlock()
+}
+
+func (index *roomIndex) remove(roomname protocol.Roomname) {
+	index.mux.Lock()
+	delete(index.rooms, roomname)
+	index.mux.Unlock()
+}
+
+// list the metas of all rooms, sorted by room name.
+func (index *roomIndex) list() []storage.RoomMeta {
+	index.mux.RLock()
+	metas := make([]storage.RoomMeta, 0, len(index.rooms))
+	for _, meta := range index.rooms {
+		metas = append(metas, meta)
+	}
+	index.mux.RUnlock()
+	sort.Slice(metas, func(i, j int) bool { return metas[i].Name < metas[j].Name })
+	return metas
+}
+
+// load the saved index, or rebuild it from storage if Ydb was not closed cleanly.
+// The saved index is removed after it is loaded, so that it is not used after a crash.
+// genRsid generates the roomsessionids of rooms that changed (see rebuild).
+func (index *roomIndex) load(store storage.Storage, genRsid func() uint32) error {
+	if index.path != "" {
+		bs, err := ioutil.ReadFile(index.path)
+		if err == nil {
+			var metas []storage.RoomMeta
+			if err = json.Unmarshal(bs, &metas); err == nil {
+				for _, meta := range metas {
+					index.rooms[meta.Name] = meta
+				}
+				if err = os.Remove(index.path); err != nil {
+					return err
+				}
+				return storage.SyncDir(filepath.Dir(index.path))
+			}
+			debug("index: ignoring corrupted index: " + err.Error())
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return index.rebuild(store, genRsid)
+}
+
+// rebuild the index from the metas in storage.
+// The persisted roomsessionid is only reused if the room was closed cleanly and no data was lost since.
+// Otherwise the room gets a new roomsessionid, so that clients resync.
+func (index *roomIndex) rebuild(store storage.Storage, genRsid func() uint32) error {
+	roomnames, err := store.List()
+	if err != nil {
+		return err
+	}
+	index.rooms = make(map[protocol.Roomname]storage.RoomMeta, len(roomnames))
+	for _, roomname := range roomnames {
+		meta, ok, err := store.ReadMeta(roomname)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if !meta.Tiered {
+			size, err := store.Size(roomname)
+			if err != nil {
+				return err
+			}
+			if !meta.Clean || meta.Offset != size {
+				// the room changed without us knowing
+				meta.Rsid = genRsid()
+				meta.Offset = size
+				meta.Modified = time.Now()
+				meta.Clean = true
+				if err = store.WriteMeta(roomname, meta, true); err != nil {
+					return err
+				}
+			}
+		}
+		index.rooms[roomname] = meta
+	}
+	return nil
+}
+
+// save the index, so that it is loaded when Ydb starts again.
+// Must only be called if all rooms were closed cleanly.
+func (index *roomIndex) save() error {
+	if index.path == "" {
+		return nil
+	}
+	bs, err := json.Marshal(index.list())
+	if err != nil {
+		return err
+	}
+	tmpPath := index.path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(bs)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmpPath, index.path); err != nil {
+		return err
+	}
+	return storage.SyncDir(filepath.Dir(index.path))
+}
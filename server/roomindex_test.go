@@ -0,0 +1,47 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestRoomIndex tests that the room index is saved on a clean close, and that it is only loaded once.
+func TestRoomIndex(t *testing.T) {
+	dir := "_test_index"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	indexPath := filepath.Join(dir, indexFilename)
+
+	ydb := newTestYdb(t, dir)
+	session := newSession(ydb, 1)
+	ydb.updateRoom(testroom, session, 0, []byte{1, 2, 3})
+	waitForRoomPersisted(ydb, testroom)
+	rsid := ydb.getRoom(testroom).roomsessionid
+	ydb.Close()
+	if _, err := os.Stat(indexPath); err != nil {
+		t.Fatalf("expected index to be saved: %s", err)
+	}
+
+	ydb = newTestYdb(t, dir)
+	session = newSession(ydb, 1)
+	if _, err := os.Stat(indexPath); !os.IsNotExist(err) {
+		t.Error("expected index to be removed after it was loaded")
+	}
+	metas := ydb.fswriter.index.list()
+	if len(metas) != 1 || metas[0].Name != testroom || metas[0].Rsid != rsid || metas[0].Offset != 3 {
+		t.Errorf("expected index to contain room %s with rsid %d and offset 3, got %v", testroom, rsid, metas)
+	}
+	ydb.updateRoom(testroom, session, 1, []byte{4})
+	waitForRoomPersisted(ydb, testroom)
+	if meta, _ := ydb.fswriter.index.get(testroom); meta.Offset != 4 {
+		t.Errorf("expected index to be updated to offset 4, got %d", meta.Offset)
+	}
+	// not closed cleanly, so the index is rebuilt from storage
+
+	ydb = newTestYdb(t, dir)
+	if meta, ok := ydb.fswriter.index.get(testroom); !ok || meta.Offset != 4 || meta.Rsid == rsid {
+		t.Errorf("expected rebuilt index to contain offset 4 and a new rsid, got %v", meta)
+	}
+	ydb.Close()
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/jwmdev/ydb/protocol"
+	"github.com/jwmdev/ydb/storage"
+)
+
+// roomMeta returns the meta of a room.
+// Expects room.mux to be locked.
+func (room *room) roomMeta(roomname protocol.Roomname, clean bool) storage.RoomMeta {
+	return storage.RoomMeta{
+		Name:     roomname,
+		Rsid:     room.roomsessionid,
+		Offset:   room.offset,
+		Created:  room.created,
+		Modified: room.modified,
+		Clean:    clean,
+		Tiered:   room.tiered,
+	}
+}
+
+// saveRoomMeta persists the meta of a room and updates the room index.
+func (fswriter *fswriter) saveRoomMeta(meta storage.RoomMeta, sync bool) error {
+	if err := fswriter.storage.WriteMeta(meta.Name, meta, sync); err != nil {
+		return err
+	}
+	fswriter.index.set(meta)
+	return nil
+}
+
+// writeRoomMeta persists the meta of a room and updates the room index.
+// Expects room.mux to be locked.
+func (fswriter *fswriter) writeRoomMeta(roomname protocol.Roomname, room *room, clean bool, sync bool) error {
+	return fswriter.saveRoomMeta(room.roomMeta(roomname, clean), sync)
+}
+
+// closeRoomMeta marks the room as cleanly closed if all data is persisted. Returns false if the room is not clean.
+// Expects room.mux to be locked.
+func (fswriter *fswriter) closeRoomMeta(roomname protocol.Roomname, room *room) bool {
+	if !room.metaDirty {
+		return true
+	}
+	if room.registered || len(room.pendingWrites) > 0 || room.quarantined {
+		return false
+	}
+	if err := fswriter.writeRoomMeta(roomname, room, true, true); err != nil {
+		fmt.Printf("ydb error: unable to close room %s: %s\n", roomname, err)
+		return false
+	}
+	room.metaDirty = false
+	return true
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/jwmdev/ydb/protocol"
+)
+
+// roomStripes is the number of lock stripes of the room registry.
+const roomStripes = 256
+
+// roomRegistry maps room names to cached rooms. Rooms are sharded into lock stripes by the hash of the room name,
+// so that rooms in different stripes are looked up and created in parallel.
+type roomRegistry struct {
+	stripes []roomStripe
+	// number of cached rooms in all stripes. Accessed atomically
+	count int64
+	// stripe that the next eviction continues with (see roomcache.go). Accessed atomically
+	evictionCursor uint32
+	// creates rooms that are not cached yet
+	newRoom func() *room
+}
+
+type roomStripe struct {
+	mux   sync.RWMutex
+	rooms map[protocol.Roomname]*room
+	// orders the rooms of the stripe by their last access (see roomcache.go)
+	lru roomLRU
+}
+
+func newRoomRegistry(stripes int, newRoom func() *room) *roomRegistry {
+	registry := &roomRegistry{stripes: make([]roomStripe, stripes), newRoom: newRoom}
+	for i := range registry.stripes {
+		registry.stripes[i].rooms = make(map[protocol.Roomname]*room)
+		registry.stripes[i].lru.init()
+	}
+	return registry
+}
+
+// stripe hashes roomname with fnv-1a. The hash is computed inline, because hash/fnv allocates on every lookup.
+func (registry *roomRegistry) stripe(roomname protocol.Roomname) *roomStripe {
+	h := uint32(2166136261)
+	for i := 0; i < len(roomname); i++ {
+		h ^= uint32(roomname[i])
+		h *= 16777619
+	}
+	return &registry.stripes[h%uint32(len(registry.stripes))]
+}
+
+// lookup returns the cached room without creating it.
+func (registry *roomRegistry) lookup(roomname protocol.Roomname) (*room, bool) {
+	stripe := registry.stripe(roomname)
+	stripe.mux.RLock()
+	r, ok := stripe.rooms[roomname]
+	stripe.mux.RUnlock()
+	return r, ok
+}
+
+// getOrCreate returns the cached room. If the room is not cached, a new room is created and initialized with init.
+// Other goroutines can't lock the new room before init returns.
+func (registry *roomRegistry) getOrCreate(roomname protocol.Roomname, init func(r *room)) (r *room, created bool) {
+	stripe := registry.stripe(roomname)
+	stripe.mux.RLock()
+	r = stripe.rooms[roomname]
+	stripe.mux.RUnlock()
+	if r != nil {
+		stripe.lru.touch(r)
+		return r, false
+	}
+	// the room is created outside of the stripe lock, because newRoom locks seedMux
+	candidate := registry.newRoom()
+	candidate.mux.Lock()
+	stripe.mux.Lock()
+	if r = stripe.rooms[roomname]; r != nil {
+		stripe.mux.Unlock()
+		stripe.lru.touch(r)
+		return r, false
+	}
+	stripe.rooms[roomname] = candidate
+	atomic.AddInt64(&registry.count, 1)
+	stripe.mux.Unlock()
+	init(candidate)
+	stripe.lru.add(roomname, candidate)
+	candidate.mux.Unlock()
+	return candidate, true
+}
+
+// remove room if it is still cached.
+func (registry *roomRegistry) remove(roomname protocol.Roomname, room *room) {
+	stripe := registry.stripe(roomname)
+	stripe.mux.Lock()
+	if stripe.rooms[roomname] == room {
+		delete(stripe.rooms, roomname)
+		atomic.AddInt64(&registry.count, -1)
+	}
+	stripe.mux.Unlock()
+}
+
+func (registry *roomRegistry) len() int {
+	return int(atomic.LoadInt64(&registry.count))
+}
+
+// snapshot copies all cached rooms, so that they can be locked without locking the registry.
+func (registry *roomRegistry) snapshot() map[protocol.Roomname]*room {
+	rooms := make(map[protocol.Roomname]*room)
+	for i := range registry.stripes {
+		stripe := &registry.stripes[i]
+		stripe.mux.RLock()
+		for name, room := range stripe.rooms {
+			rooms[name] = room
+		}
+		stripe.mux.RUnlock()
+	}
+	return rooms
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/jwmdev/ydb/protocol"
+)
+
+// globalRoomRegistry is the room registry before it was striped: a single map and a single lru.
+// New rooms are created while the write lock is held. It is the baseline for BenchmarkRoomRegistry.
+type globalRoomRegistry struct {
+	mux   sync.RWMutex
+	rooms map[protocol.Roomname]*room
+	lru   roomLRU
+	// creates rooms that are not cached yet
+	newRoom func() *room
+}
+
+func (registry *globalRoomRegistry) getOrCreate(roomname protocol.Roomname) *room {
+	registry.mux.RLock()
+	r := registry.rooms[roomname]
+	registry.mux.RUnlock()
+	if r != nil {
+		registry.lru.touch(r)
+		return r
+	}
+	registry.mux.Lock()
+	if r = registry.rooms[roomname]; r == nil {
+		r = registry.newRoom()
+		registry.rooms[roomname] = r
+		registry.lru.add(roomname, r)
+	}
+	registry.mux.Unlock()
+	return r
+}
+
+// BenchmarkRoomRegistry compares the striped registry with the global registry, when clients create
+// distinct rooms in parallel, and when they access a shared set of rooms.
+func BenchmarkRoomRegistry(b *testing.B) {
+	ydb := &Ydb{seed: rand.New(rand.NewSource(1))}
+	init := func(r *room) {}
+	newGlobal := func() *globalRoomRegistry {
+		registry := &globalRoomRegistry{rooms: make(map[protocol.Roomname]*room), newRoom: ydb.newRoom}
+		registry.lru.init()
+		return registry
+	}
+	b.Run("distinct/global", func(b *testing.B) {
+		registry := newGlobal()
+		var n uint64
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				registry.getOrCreate(protocol.Roomname(strconv.FormatUint(atomic.AddUint64(&n, 1), 10)))
+			}
+		})
+	})
+	b.Run("distinct/striped", func(b *testing.B) {
+		registry := newRoomRegistry(roomStripes, ydb.newRoom)
+		var n uint64
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				registry.getOrCreate(protocol.Roomname(strconv.FormatUint(atomic.AddUint64(&n, 1), 10)), init)
+			}
+		})
+	})
+	const sharedRooms = 10000
+	b.Run("shared/global", func(b *testing.B) {
+		registry := newGlobal()
+		var n uint64
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				registry.getOrCreate(protocol.Roomname(strconv.FormatUint(atomic.AddUint64(&n, 1)%sharedRooms, 10)))
+			}
+		})
+	})
+	b.Run("shared/striped", func(b *testing.B) {
+		registry := newRoomRegistry(roomStripes, ydb.newRoom)
+		var n uint64
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				registry.getOrCreate(protocol.Roomname(strconv.FormatUint(atomic.AddUint64(&n, 1)%sharedRooms, 10)), init)
+			}
+		})
+	})
+}
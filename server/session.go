@@ -0,0 +1,336 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/jwmdev/ydb/protocol"
+)
+
+// serverConfirmation keeps track of confirmations created by the server.
+// serverConfirmation.next is attached to data sent from the server to a client (via some conn).
+// When the client confirms a serverConfirmation number, it assures that it consumed and persisted the sent data data.
+// Hence the server does not have to keep track of roomsChanged since last confirmed message.
+type serverConfirmation struct {
+	// current confirmation number
+	next uint64
+	// next expected confirmation from client
+	nextClient uint64
+	// rooms changed since last confirmation.
+	roomsChanged map[protocol.Roomname]uint64
+}
+
+func (serverConfirmation *serverConfirmation) createConfirmation() uint64 {
+	conf := serverConfirmation.next
+	serverConfirmation.next++
+	return conf
+}
+
+// client confirmed that it received and persisted data.
+func (serverConfirmation *serverConfirmation) clientConfirmed(confirmed uint64) {
+	if serverConfirmation.nextClient <= confirmed {
+		serverConfirmation.nextClient = confirmed + 1
+		// recreate a new roomsChanged map to assure that memory does not grow
+		roomsChanged := serverConfirmation.roomsChanged
+		serverConfirmation.roomsChanged = make(map[protocol.Roomname]uint64, 1)
+		// re-insert all rooms that are not yet confirmed
+		for roomname, n := range roomsChanged {
+			if n > confirmed {
+				serverConfirmation.roomsChanged[roomname] = n
+			}
+		}
+	}
+}
+
+// clientConfirmation keeps track of confirmation numbers received from the client.
+// ydb confirms messages when they are consumed and persisted on the disk.
+// The client will receive confirmations in-order. But since the process of persisting
+// data is asynchronous, it may happen that confirmations are created out-of-order.
+// I.e. The client wrote data to room "a" (confirmation 0) then "b" (confirmation 1).
+// But the server creates confirmation 1, then 0. We keep track of the confirmations in a map.
+type clientConfirmation struct {
+	// next expected confirmation
+	next uint64
+	// set of out-of-order created confirmations (none of them is `next`)
+	confs map[uint64]struct{}
+}
+
+func (conf *clientConfirmation) serverConfirmed(confirmed uint64) (updated bool) {
+	if conf.next == confirmed {
+		conf.next = confirmed + 1
+		if conf.confs != nil {
+			_, ok := conf.confs[conf.next]
+			for ok {
+				_, ok = conf.confs[conf.next]
+				conf.next++
+			}
+		}
+		if conf.next != confirmed+1 {
+			// conf updated based on confs
+			// conf.confs needs to be updated
+			oldConfs := conf.confs
+			newConfs := make(map[uint64]struct{}, 0)
+			for n := range oldConfs {
+				newConfs[n] = struct{}{}
+			}
+			if len(newConfs) > 0 {
+				conf.confs = newConfs
+			} else {
+				conf.confs = nil
+			}
+		}
+		return true
+	}
+	if conf.confs == nil {
+		conf.confs = make(map[uint64]struct{}, 1)
+	}
+	conf.confs[confirmed] = struct{}{}
+	return false
+}
+
+type session struct {
+	mux sync.Mutex
+	// currently active connection
+	conn conn
+	// set of all conns
+	conns []conn
+	// client confirming messages to server
+	serverConfirmation serverConfirmation
+	// server confirming messages to client
+	clientConfirmation clientConfirmation
+	sessionid          uint64
+	// owning instance
+	ydb *Ydb
+	// trusted sessions may compact rooms
+	trusted bool
+	// whether the first message was read (see handshake.go). Only accessed by the read pump
+	handshaken bool
+	// negotiated protocol version and features. Protected by mux
+	version  uint64
+	features uint64
+	// outbound messages that the send task did not deliver yet. Protected by mux
+	outbox      []outboxMessage
+	outboxBytes int
+	// rooms whose updates are dropped until the session is resubscribed (see slowconsumer.go)
+	resyncing map[protocol.Roomname]struct{}
+	// rooms that continue to send their content when the outbox is drained (see fswriter.sendRoomTail)
+	catchups map[protocol.Roomname]struct{}
+	// signals the send task that the outbox or the conn changed
+	outboxCond *sync.Cond
+	// whether the send task is running
+	sending bool
+	// whether the send task is delivering messages that were taken from the outbox
+	delivering bool
+}
+
+func newSession(ydb *Ydb, sessionid uint64) *session {
+	s := &session{
+		sessionid: sessionid,
+		ydb:       ydb,
+	}
+	s.outboxCond = sync.NewCond(&s.mux)
+	return s
+}
+
+func (s *session) sendConfirmedByHost(roomname protocol.Roomname, offset uint64) {
+	s.send(protocol.CreateMessageConfirmedByHost(roomname, offset))
+	/* TODO: use the following for UnconfirmedHostByClient
+	s.mux.Lock()
+	if s.clientConfirmation.serverConfirmed(confirmation) {
+		confMessage := protocol.CreateMessageConfirmation(confirmation)
+		pmessage, err := websocket.NewPreparedMessage(websocket.BinaryMessage, confMessage)
+		if err != nil {
+			fmt.Printf("ydb error creating formatted message: %s", err)
+			return
+		}
+		if s.conn != nil {
+			s.conn.WriteMessage(confMessage, pmessage)
+		}
+	}
+	s.mux.Unlock()
+	*/
+}
+
+// outboxMessage is a message in the outbox of a session.
+type outboxMessage struct {
+	bs []byte
+	// nil if the send task prepares the message. Messages that are sent to many sessions are prepared once
+	pm *websocket.PreparedMessage
+	// roomname, offset, and the length of the data are set for updates, so that they can be coalesced or resynced
+	roomname protocol.Roomname
+	offset   uint64
+	dataLen  int
+}
+
+// send queues a message in the outbox of the session. It never blocks, so rooms can notify subscribers while they
+// are locked. This keeps messages of a room in order, while slow connections only delay the send task of their session.
+// Messages are dropped if the session has no conn.
+func (s *session) send(bs []byte) {
+	s.enqueue(outboxMessage{bs: bs})
+}
+
+func (s *session) enqueue(m outboxMessage) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.conn == nil {
+		return
+	}
+	if _, ok := s.resyncing[m.roomname]; ok && m.dataLen > 0 {
+		// the update is sent again when the session is resubscribed
+		return
+	}
+	s.outbox = append(s.outbox, m)
+	s.outboxBytes += len(m.bs)
+	if s.ydb.slowConsumer.exceeded(len(s.outbox), s.outboxBytes) {
+		s.handleSlowConsumer()
+	}
+	s.outboxCond.Signal()
+}
+
+// sendTask delivers the outbox to the current conn. It ends when the session has no conn anymore.
+func (s *session) sendTask() {
+	s.mux.Lock()
+	for {
+		for len(s.outbox) == 0 && len(s.catchups) == 0 && s.conn != nil {
+			s.outboxCond.Wait()
+		}
+		if s.conn == nil {
+			s.outbox = nil
+			s.outboxBytes = 0
+			s.catchups = nil
+			s.sending = false
+			s.mux.Unlock()
+			return
+		}
+		messages := s.outbox
+		conn := s.conn
+		s.outbox = nil
+		s.outboxBytes = 0
+		var catchups map[protocol.Roomname]struct{}
+		if len(messages) == 0 {
+			// the outbox is drained. Rooms can continue to send their content
+			catchups = s.catchups
+			s.catchups = nil
+		}
+		s.delivering = true
+		s.mux.Unlock()
+		for _, m := range messages {
+			pm := m.pm
+			if pm == nil {
+				pm, _ = websocket.NewPreparedMessage(websocket.BinaryMessage, m.bs)
+			}
+			conn.WriteMessage(m.bs, pm)
+		}
+		for roomname := range catchups {
+			// register the room, so that the fswriter serves the pending subs
+			s.ydb.modifyRoom(roomname, func(room *room) bool {
+				return len(room.pendingSubs) > 0
+			})
+		}
+		s.mux.Lock()
+		s.delivering = false
+	}
+}
+
+// outboxHasRoom reports whether the outbox can take more content of a room that a subscriber catches up with.
+// Leaves room for live updates.
+func (s *session) outboxHasRoom() bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return !s.ydb.slowConsumer.exceeded(2*len(s.outbox), 2*s.outboxBytes)
+}
+
+// waitForCatchup continues to send the content of a room when the outbox is drained.
+func (s *session) waitForCatchup(name protocol.Roomname) {
+	s.mux.Lock()
+	if s.catchups == nil {
+		s.catchups = make(map[protocol.Roomname]struct{})
+	}
+	s.catchups[name] = struct{}{}
+	s.outboxCond.Signal()
+	s.mux.Unlock()
+}
+
+// prepareMessage frames a message once, so that it can be sent to many sessions.
+func prepareMessage(bs []byte) outboxMessage {
+	pm, err := websocket.NewPreparedMessage(websocket.BinaryMessage, bs)
+	if err != nil {
+		// the send task prepares the message for every session
+		pm = nil
+	}
+	return outboxMessage{bs: bs, pm: pm}
+}
+
+// prepareUpdate frames an update once, so that it can be sent to all subscribers of a room.
+func prepareUpdate(roomname protocol.Roomname, data []byte, offset uint64) outboxMessage {
+	m := prepareMessage(protocol.CreateMessageUpdate(roomname, offset, data))
+	m.roomname = roomname
+	m.offset = offset
+	m.dataLen = len(data)
+	return m
+}
+
+func (s *session) sendUpdate(roomname protocol.Roomname, data []byte, offset uint64) {
+	if len(data) > 0 {
+		s.enqueue(outboxMessage{bs: protocol.CreateMessageUpdate(roomname, offset, data), roomname: roomname, offset: offset, dataLen: len(data)})
+	}
+}
+
+func (s *session) sendHostUnconfirmedByClient(clientConf uint64, offset uint64) {
+	s.send(protocol.CreateMessageHostUnconfirmedByClient(clientConf, offset))
+}
+
+func (s *session) add(conn conn) {
+	s.mux.Lock()
+	s.conns = append(s.conns, conn)
+	if s.conn == nil {
+		s.conn = conn
+	}
+	if !s.sending {
+		s.sending = true
+		go s.sendTask()
+	}
+	s.mux.Unlock()
+}
+
+// closeConns closes all conns of the session with a websocket close code. Expects s.mux to be unlocked.
+func (s *session) closeConns(code int, reason string) {
+	s.mux.Lock()
+	conns := append([]conn(nil), s.conns...)
+	s.mux.Unlock()
+	for _, conn := range conns {
+		conn.Close(code, reason)
+	}
+}
+
+// drained returns true if the send task delivered all messages of the outbox.
+func (s *session) drained() bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return len(s.outbox) == 0 && !s.delivering
+}
+
+func (s *session) removeConn(c conn) {
+	s.mux.Lock()
+	var newConns []conn
+	for _, conn := range s.conns {
+		if c != conn {
+			newConns = append(newConns, conn)
+		}
+	}
+	s.conns = newConns
+	if s.conn == c {
+		if s.conns != nil { // conns is not empty
+			s.conn = s.conns[0]
+		} else {
+			s.conn = nil
+		}
+	}
+	if s.conn == nil {
+		s.ydb.removeSession(s.sessionid)
+		// end the send task
+		s.outboxCond.Signal()
+	}
+	s.mux.Unlock()
+}
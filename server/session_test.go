@@ -0,0 +1,118 @@
+package server
+
+import (
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/jwmdev/ydb/protocol"
+)
+
+// blockingConn never delivers a message.
+type blockingConn struct {
+	unblock chan struct{}
+}
+
+func (c *blockingConn) WriteMessage(m []byte, pm *websocket.PreparedMessage) {
+	<-c.unblock
+}
+
+func (c *blockingConn) Close(code int, reason string) {}
+
+// TestSlowSubscriber tests that a subscriber that does not consume messages does not block the room.
+func TestSlowSubscriber(t *testing.T) {
+	dir := "_test_slow"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	ydb := newTestYdb(t, dir)
+	defer ydb.Close()
+	writer := newSession(ydb, 1)
+	slow := newSession(ydb, 2)
+	blocking := &blockingConn{make(chan struct{})}
+	defer close(blocking.unblock)
+	slow.add(blocking)
+	fast := newSession(ydb, 3)
+	conn := &recordingConn{}
+	fast.add(conn)
+	ydb.subscribeRoom(testroom, slow, 0, 0)
+	ydb.subscribeRoom(testroom, fast, 0, 0)
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			ydb.updateRoom(testroom, writer, uint64(i), []byte{byte(i)})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("updates are blocked by a slow subscriber")
+	}
+	waitForRoomPersisted(ydb, testroom)
+	waitForDelivery(fast)
+	if !conn.contains(protocol.CreateMessageUpdate(testroom, 100, []byte{99})) {
+		t.Error("expected fast subscriber to receive all updates")
+	}
+}
+
+// countingConn counts delivered messages.
+type countingConn struct {
+	delivered int64
+}
+
+func (c *countingConn) WriteMessage(m []byte, pm *websocket.PreparedMessage) {
+	atomic.AddInt64(&c.delivered, 1)
+}
+
+func (c *countingConn) Close(code int, reason string) {}
+
+// BenchmarkFanOut sends updates to 500 subscribers, with a prepared message per subscriber and with a shared one.
+func BenchmarkFanOut(b *testing.B) {
+	const subscribers = 500
+	data := make([]byte, 100)
+	run := func(b *testing.B, send func(subs []*session, offset uint64)) {
+		subs := make([]*session, subscribers)
+		conns := make([]*countingConn, subscribers)
+		ydb := &Ydb{}
+		for i := range subs {
+			conns[i] = &countingConn{}
+			subs[i] = newSession(ydb, uint64(i))
+			subs[i].add(conns[i])
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			send(subs, uint64(i+1)*uint64(len(data)))
+		}
+		for _, conn := range conns {
+			for atomic.LoadInt64(&conn.delivered) < int64(b.N) {
+				time.Sleep(time.Millisecond)
+			}
+		}
+		b.StopTimer()
+		for i := range subs {
+			subs[i].mux.Lock()
+			subs[i].conn = nil
+			subs[i].outboxCond.Signal()
+			subs[i].mux.Unlock()
+		}
+	}
+	b.Run("per-subscriber", func(b *testing.B) {
+		run(b, func(subs []*session, offset uint64) {
+			for _, s := range subs {
+				s.sendUpdate(testroom, data, offset)
+			}
+		})
+	})
+	b.Run("shared", func(b *testing.B) {
+		run(b, func(subs []*session, offset uint64) {
+			update := prepareUpdate(testroom, data, offset)
+			for _, s := range subs {
+				s.enqueue(update)
+			}
+		})
+	})
+}
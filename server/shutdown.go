@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// How often Shutdown checks whether rooms and outboxes are flushed.
+const shutdownPollInterval = 10 * time.Millisecond
+
+// Shutdown gracefully stops ydb. New connections are rejected and incoming messages are ignored (clients send
+// unconfirmed messages again when they reconnect). Shutdown waits until all pending writes are persisted and all
+// outboxes are delivered, closes the connections with a "going away" close frame, and closes ydb.
+//
+// If ctx expires first, the connections are closed anyway and ctx.Err() is returned. ydb is still closed if only the
+// outboxes were not delivered, so that the rooms keep their roomsessionid. The storage is left open if writes are
+// pending, because write tasks may still be running.
+func (ydb *Ydb) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&ydb.closing, 1)
+	flushErr := waitUntil(ctx, ydb.roomsFlushed)
+	err := flushErr
+	if flushErr == nil {
+		// a client that stops reading must not keep the rooms from being closed cleanly
+		err = waitUntil(ctx, ydb.sessionsDrained)
+	}
+	for _, s := range ydb.snapshotSessions() {
+		s.closeConns(websocket.CloseGoingAway, "server shutting down")
+	}
+	if flushErr != nil {
+		return flushErr
+	}
+	ydb.Close()
+	return err
+}
+
+func (ydb *Ydb) shuttingDown() bool {
+	return atomic.LoadInt32(&ydb.closing) == 1
+}
+
+// roomsFlushed returns true if no room has writes that are not persisted yet.
+func (ydb *Ydb) roomsFlushed() bool {
+	for _, room := range ydb.rooms.snapshot() {
+		room.mux.Lock()
+		pending := room.registered || len(room.pendingWrites) > 0
+		room.mux.Unlock()
+		if pending {
+			return false
+		}
+	}
+	return true
+}
+
+// sessionsDrained returns true if all outboxes are delivered.
+func (ydb *Ydb) sessionsDrained() bool {
+	for _, s := range ydb.snapshotSessions() {
+		if !s.drained() {
+			return false
+		}
+	}
+	return true
+}
+
+func (ydb *Ydb) snapshotSessions() []*session {
+	ydb.sessionsMux.Lock()
+	defer ydb.sessionsMux.Unlock()
+	sessions := make([]*session, 0, len(ydb.sessions))
+	for _, s := range ydb.sessions {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+// waitUntil polls done until it returns true or ctx expires.
+func waitUntil(ctx context.Context, done func() bool) error {
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for !done() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/jwmdev/ydb/storage"
+)
+
+// TestShutdown tests that Shutdown persists pending writes, closes conns with "going away", and rejects new conns.
+func TestShutdown(t *testing.T) {
+	dir := "_test_shutdown"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	ydb := newTestYdb(t, dir)
+	s := ydb.createSession()
+	conn := &closingConn{}
+	s.add(conn)
+	ydb.updateRoom(testroom, s, 0, []byte{1, 2, 3})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ydb.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if code := atomic.LoadInt32(&conn.closed); code != websocket.CloseGoingAway {
+		t.Errorf("expected conn to be closed with code %d, got %d", websocket.CloseGoingAway, code)
+	}
+	w := httptest.NewRecorder()
+	ydb.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/ws", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected new conns to be rejected, got status %d", w.Code)
+	}
+
+	store, err := storage.Open(storage.KindFile, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if meta, ok, _ := store.ReadMeta(testroom); !ok || !meta.Clean {
+		t.Errorf("expected room to be closed cleanly, got %v", meta)
+	}
+	r, _ := store.ReadFrom(testroom, 0)
+	data, _ := ioutil.ReadAll(r)
+	r.Close()
+	if !bytes.Equal(data, []byte{1, 2, 3}) {
+		t.Errorf("expected persisted content [1 2 3], got %v", data)
+	}
+}
+
+// TestShutdownUndeliveredOutbox tests that rooms are closed cleanly if a client does not read its outbox.
+func TestShutdownUndeliveredOutbox(t *testing.T) {
+	dir := "_test_shutdown_undelivered"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	ydb := newTestYdb(t, dir)
+	conn := &closingConn{}
+	s := newUndeliveredSession(ydb, 1, conn)
+	ydb.sessions[s.sessionid] = s
+	ydb.updateRoom(testroom, s, 0, []byte{1, 2, 3})
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if err := ydb.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected the undelivered outbox to time out, got %v", err)
+	}
+	if code := atomic.LoadInt32(&conn.closed); code != websocket.CloseGoingAway {
+		t.Errorf("expected conn to be closed with code %d, got %d", websocket.CloseGoingAway, code)
+	}
+	store, err := storage.Open(storage.KindFile, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if meta, ok, _ := store.ReadMeta(testroom); !ok || !meta.Clean {
+		t.Errorf("expected room to be closed cleanly, got %v", meta)
+	}
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+	"github.com/jwmdev/ydb/protocol"
+)
+
+// Slow consumers are sessions whose outbox exceeds the limits of SlowConsumerConfig, because the client does not
+// read messages as fast as they are sent. The policy decides how Ydb frees the outbox.
+type SlowConsumerPolicy uint8
+
+const (
+	// close all conns of the session. The client reconnects and subscribes again
+	SlowConsumerDisconnect SlowConsumerPolicy = iota + 1
+	// drop queued updates, and subscribe the session again at the offset of the first dropped update of each room
+	SlowConsumerResubscribe
+	// merge consecutive updates of the same room into a single update. Disconnects if the outbox still exceeds the limits
+	SlowConsumerCoalesce
+)
+
+const (
+	DefaultOutboxMaxMessages = 10000
+	DefaultOutboxMaxBytes    = 64 << 20
+)
+
+// slowConsumerMetrics counts the slow consumers of a Ydb instance and the applied policies. Served by
+// Ydb.MetricsHandler. Accessed atomically
+type slowConsumerMetrics struct {
+	Detected     int64 `json:"detected"`
+	Coalesced    int64 `json:"coalesced"`
+	Resubscribed int64 `json:"resubscribed"`
+	Disconnected int64 `json:"disconnected"`
+}
+
+func (m *slowConsumerMetrics) snapshot() slowConsumerMetrics {
+	return slowConsumerMetrics{
+		Detected:     atomic.LoadInt64(&m.Detected),
+		Coalesced:    atomic.LoadInt64(&m.Coalesced),
+		Resubscribed: atomic.LoadInt64(&m.Resubscribed),
+		Disconnected: atomic.LoadInt64(&m.Disconnected),
+	}
+}
+
+func (p SlowConsumerPolicy) String() string {
+	switch p {
+	case SlowConsumerDisconnect:
+		return "disconnect"
+	case SlowConsumerResubscribe:
+		return "resubscribe"
+	case SlowConsumerCoalesce:
+		return "coalesce"
+	}
+	return fmt.Sprintf("slowConsumerPolicy(%d)", uint8(p))
+}
+
+func ParseSlowConsumerPolicy(s string) (SlowConsumerPolicy, error) {
+	for _, p := range []SlowConsumerPolicy{SlowConsumerDisconnect, SlowConsumerResubscribe, SlowConsumerCoalesce} {
+		if p.String() == s {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown slow consumer policy \"%s\" (expected disconnect, resubscribe, or coalesce)", s)
+}
+
+// SlowConsumerConfig limits the outbox of each session. New replaces a limit of zero with its default
+// (DefaultOutboxMaxMessages, DefaultOutboxMaxBytes) and the zero policy with SlowConsumerResubscribe.
+// A negative limit is unlimited.
+type SlowConsumerConfig struct {
+	MaxMessages int
+	MaxBytes    int
+	Policy      SlowConsumerPolicy
+}
+
+func (config SlowConsumerConfig) exceeded(messages int, bytes int) bool {
+	return (config.MaxMessages > 0 && messages > config.MaxMessages) || (config.MaxBytes > 0 && bytes > config.MaxBytes)
+}
+
+// handleSlowConsumer applies the slow consumer policy.
+// Expects s.mux to be locked. Rooms may be locked too, so rooms are only modified asynchronously.
+func (s *session) handleSlowConsumer() {
+	atomic.AddInt64(&s.ydb.slowConsumerMetrics.Detected, 1)
+	switch s.ydb.slowConsumer.Policy {
+	case SlowConsumerCoalesce:
+		s.coalesceOutbox()
+		if !s.ydb.slowConsumer.exceeded(len(s.outbox), s.outboxBytes) {
+			atomic.AddInt64(&s.ydb.slowConsumerMetrics.Coalesced, 1)
+			return
+		}
+	case SlowConsumerResubscribe:
+		rooms := s.dropOutboxUpdates()
+		atomic.AddInt64(&s.ydb.slowConsumerMetrics.Resubscribed, 1)
+		go s.resubscribe(rooms)
+		return
+	}
+	atomic.AddInt64(&s.ydb.slowConsumerMetrics.Disconnected, 1)
+	s.outbox = nil
+	s.outboxBytes = 0
+	go s.closeConns(websocket.ClosePolicyViolation, "slow consumer")
+}
+
+// coalesceOutbox merges consecutive updates of the same room.
+// Expects s.mux to be locked.
+func (s *session) coalesceOutbox() {
+	var outbox []outboxMessage
+	bytes := 0
+	for _, m := range s.outbox {
+		if n := len(outbox); n > 0 && m.dataLen > 0 && outbox[n-1].dataLen > 0 && outbox[n-1].roomname == m.roomname {
+			prev := outbox[n-1]
+			data := append(append([]byte(nil), prev.bs[len(prev.bs)-prev.dataLen:]...), m.bs[len(m.bs)-m.dataLen:]...)
+			bytes -= len(prev.bs)
+			m = outboxMessage{bs: protocol.CreateMessageUpdate(m.roomname, m.offset, data), roomname: m.roomname, offset: m.offset, dataLen: len(data)}
+			outbox = outbox[:n-1]
+		}
+		outbox = append(outbox, m)
+		bytes += len(m.bs)
+	}
+	s.outbox = outbox
+	s.outboxBytes = bytes
+}
+
+// dropOutboxUpdates removes all updates from the outbox. Returns the offset of the first dropped update of each room.
+// Updates of these rooms are dropped until the session is resubscribed.
+// Expects s.mux to be locked.
+func (s *session) dropOutboxUpdates() map[protocol.Roomname]uint32 {
+	rooms := make(map[protocol.Roomname]uint32)
+	var outbox []outboxMessage
+	bytes := 0
+	for _, m := range s.outbox {
+		if m.dataLen == 0 {
+			outbox = append(outbox, m)
+			bytes += len(m.bs)
+			continue
+		}
+		if _, ok := rooms[m.roomname]; !ok {
+			rooms[m.roomname] = uint32(m.offset) - uint32(m.dataLen)
+		}
+	}
+	if s.resyncing == nil {
+		s.resyncing = make(map[protocol.Roomname]struct{})
+	}
+	for roomname := range rooms {
+		s.resyncing[roomname] = struct{}{}
+	}
+	s.outbox = outbox
+	s.outboxBytes = bytes
+	return rooms
+}
+
+// resubscribe turns the session into a pending subscriber of each room, so that the fswriter sends the dropped
+// content again.
+func (s *session) resubscribe(rooms map[protocol.Roomname]uint32) {
+	for roomname, offset := range rooms {
+		s.ydb.modifyRoom(roomname, func(room *room) bool {
+			s.mux.Lock()
+			_, resyncing := s.resyncing[roomname]
+			delete(s.resyncing, roomname)
+			s.mux.Unlock()
+			if !resyncing {
+				// the session unsubscribed in the meantime
+				return false
+			}
+			var subs []*session
+			for _, sub := range room.subs {
+				if sub != s {
+					subs = append(subs, sub)
+				}
+			}
+			room.subs = subs
+			for i, sub := range room.pendingSubs {
+				if sub.session == s {
+					// the session is still catching up
+					if offset < sub.offset {
+						room.pendingSubs[i].offset = offset
+					}
+					return true
+				}
+			}
+			room.pendingSubs = append(room.pendingSubs, pendingSub{session: s, offset: offset})
+			return true
+		})
+	}
+}
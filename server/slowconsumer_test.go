@@ -0,0 +1,160 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/jwmdev/ydb/protocol"
+	"github.com/jwmdev/ydb/storage"
+)
+
+// closingConn records the close code.
+type closingConn struct {
+	closed int32
+}
+
+func (c *closingConn) WriteMessage(m []byte, pm *websocket.PreparedMessage) {}
+
+func (c *closingConn) Close(code int, reason string) {
+	atomic.StoreInt32(&c.closed, int32(code))
+}
+
+// newUndeliveredSession creates a session whose outbox is not delivered until the send task is started with add.
+func newUndeliveredSession(ydb *Ydb, sessionid uint64, c conn) *session {
+	s := newSession(ydb, sessionid)
+	s.conn = c
+	s.conns = []conn{c}
+	return s
+}
+
+func waitFor(t *testing.T, what string, f func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !f() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestSlowConsumerDisconnect(t *testing.T) {
+	ydb := &Ydb{slowConsumer: SlowConsumerConfig{MaxMessages: 2, Policy: SlowConsumerDisconnect}}
+	conn := &closingConn{}
+	s := newUndeliveredSession(ydb, 1, conn)
+	for i := 0; i < 3; i++ {
+		s.sendConfirmedByHost(testroom, uint64(i))
+	}
+	waitFor(t, "the conn to be closed", func() bool { return atomic.LoadInt32(&conn.closed) == websocket.ClosePolicyViolation })
+	if len(s.outbox) != 0 {
+		t.Errorf("expected the outbox to be dropped, got %d messages", len(s.outbox))
+	}
+	// the metrics of other instances are independent
+	other := &Ydb{}
+	if m := ydb.slowConsumerMetrics.snapshot(); m.Detected != 1 || m.Disconnected != 1 {
+		t.Errorf("expected one disconnected slow consumer, got %+v", m)
+	}
+	if m := other.slowConsumerMetrics.snapshot(); m != (slowConsumerMetrics{}) {
+		t.Errorf("expected no slow consumers in another instance, got %+v", m)
+	}
+}
+
+func TestSlowConsumerCoalesce(t *testing.T) {
+	ydb := &Ydb{slowConsumer: SlowConsumerConfig{MaxMessages: 3, Policy: SlowConsumerCoalesce}}
+	s := newUndeliveredSession(ydb, 1, &closingConn{})
+	for i := 0; i < 4; i++ {
+		s.sendUpdate(testroom, []byte{byte(i)}, uint64(i+1))
+	}
+	s.sendUpdate("other", []byte{9}, 1)
+	expected := [][]byte{
+		protocol.CreateMessageUpdate(testroom, 4, []byte{0, 1, 2, 3}),
+		protocol.CreateMessageUpdate("other", 1, []byte{9}),
+	}
+	if len(s.outbox) != len(expected) {
+		t.Fatalf("expected %d coalesced messages, got %d", len(expected), len(s.outbox))
+	}
+	for i, m := range expected {
+		if !bytes.Equal(s.outbox[i].bs, m) {
+			t.Errorf("message %d: expected %v, got %v", i, m, s.outbox[i].bs)
+		}
+	}
+}
+
+// TestSlowConsumerResubscribe tests that dropped updates are sent again when the client reads its messages again.
+func TestSlowConsumerResubscribe(t *testing.T) {
+	dir := "_test_resubscribe"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	ydb := newTestYdb(t, dir)
+	defer ydb.Close()
+	ydb.slowConsumer = SlowConsumerConfig{MaxMessages: 5, Policy: SlowConsumerResubscribe}
+	writer := newSession(ydb, 1)
+	conn := &recordingConn{}
+	subscriber := newUndeliveredSession(ydb, 2, conn)
+	ydb.subscribeRoom(testroom, subscriber, 0, 0)
+	for i := 0; i < 10; i++ {
+		ydb.updateRoom(testroom, writer, uint64(i), []byte{byte(i)})
+	}
+	waitForRoomPersisted(ydb, testroom)
+	// start to read messages
+	subscriber.conns = nil
+	subscriber.conn = nil
+	subscriber.add(conn)
+	waitFor(t, "the subscriber to catch up", func() bool {
+		return conn.contains(protocol.CreateMessageConfirmedByHost(testroom, 10))
+	})
+	var content []byte
+	conn.mux.Lock()
+	for _, m := range conn.messages {
+		buf := bytes.NewBuffer(m)
+		if t, _ := binary.ReadUvarint(buf); t == protocol.MessageUpdate {
+			binary.ReadUvarint(buf)
+			protocol.ReadRoomname(buf)
+			data, _ := protocol.ReadPayload(buf)
+			content = append(content, data...)
+		}
+	}
+	conn.mux.Unlock()
+	if !bytes.Equal(content, []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}) {
+		t.Errorf("expected the subscriber to receive all updates once, got %v", content)
+	}
+}
+
+// TestSlowConsumerDefaults tests that outboxes are limited by default, and that the metrics are served by
+// MetricsHandler only.
+func TestSlowConsumerDefaults(t *testing.T) {
+	ydb, err := New(Options{Storage: storage.KindMemory})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ydb.Close()
+	expected := SlowConsumerConfig{MaxMessages: DefaultOutboxMaxMessages, MaxBytes: DefaultOutboxMaxBytes, Policy: SlowConsumerResubscribe}
+	if ydb.slowConsumer != expected {
+		t.Errorf("expected %+v, got %+v", expected, ydb.slowConsumer)
+	}
+	if (SlowConsumerConfig{MaxMessages: -1, MaxBytes: -1}).exceeded(math.MaxInt32, math.MaxInt32) {
+		t.Error("expected negative limits to be unlimited")
+	}
+	w := httptest.NewRecorder()
+	ydb.MetricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"slowConsumers"`) {
+		t.Errorf("expected the slow consumer metrics to be served, got status %d", w.Code)
+	}
+	// the websocket handler is public, so it must not serve metrics or other debug endpoints
+	for _, path := range []string{"/debug/vars", "/clearAll"} {
+		w = httptest.NewRecorder()
+		ydb.Handler().ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected %s not to be served by Handler, got status %d", path, w.Code)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jwmdev/ydb/protocol"
+)
+
+// Tiering moves rooms that were not modified for a long time to a blob store (e.g. an S3 bucket).
+// Only the meta of a tiered room stays in the storage (the stub). It holds the offset and the roomsessionid,
+// so clients can subscribe to a tiered room without loading its content.
+// The content is rehydrated when the room is accessed again (see modifyRoom).
+
+func roomBlobKey(roomname protocol.Roomname) string {
+	h := sha256.Sum256([]byte(roomname))
+	return "rooms/" + hex.EncodeToString(h[:])
+}
+
+// StartTiering periodically moves rooms that were idle for maxIdle to the blob store of the fswriter.
+// Tiering stops when ydb is closed. Fails if ydb has no blob store (see Options.Blobs).
+func (ydb *Ydb) StartTiering(maxIdle time.Duration, interval time.Duration) error {
+	if ydb.fswriter.blobs == nil {
+		return errors.New("tiering requires a blob store")
+	}
+	ydb.background.Add(1)
+	go func() {
+		defer ydb.background.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ydb.closed:
+				return
+			}
+			n, err := ydb.tierIdleRooms(maxIdle)
+			if err != nil {
+				fmt.Printf("ydb error: tiering failed: %s\n", err)
+			}
+			debug(fmt.Sprintf("tiering: moved %d rooms to the blob store", n))
+		}
+	}()
+	return nil
+}
+
+// tierIdleRooms moves all rooms that were idle for maxIdle to the blob store. Rooms that are idle afterwards are
+// evicted, so that tiering does not fill the cache with the rooms that it loads.
+func (ydb *Ydb) tierIdleRooms(maxIdle time.Duration) (tiered int, err error) {
+	now := time.Now()
+	for _, meta := range ydb.fswriter.index.list() {
+		if meta.Tiered || now.Sub(meta.Modified) < maxIdle {
+			continue
+		}
+		room := ydb.lockRoom(meta.Name)
+		moved, err := ydb.fswriter.tierRoom(meta.Name, room, maxIdle)
+		if room.idle() {
+			ydb.rooms.stripe(meta.Name).lru.remove(room)
+			ydb.evictRoom(meta.Name, room)
+		}
+		room.mux.Unlock()
+		if err != nil {
+			return tiered, err
+		}
+		if moved {
+			tiered++
+		}
+	}
+	return
+}
+
+// tierRoom streams the content of a room to the blob store if the room is idle.
+// Expects room.mux to be locked.
+func (fswriter *fswriter) tierRoom(roomname protocol.Roomname, room *room, maxIdle time.Duration) (bool, error) {
+	if room.tiered || room.offset == 0 || !room.idle() || time.Since(room.modified) < maxIdle {
+		return false, nil
+	}
+	store := fswriter.storage
+	r, err := store.ReadFrom(roomname, 0)
+	if err != nil {
+		return false, err
+	}
+	err = fswriter.blobs.Put(roomBlobKey(roomname), r, int64(room.offset))
+	r.Close()
+	if err != nil {
+		return false, fmt.Errorf("room %s: unable to move %d bytes to the blob store: %s", roomname, room.offset, err)
+	}
+	room.tiered = true
+	if err = fswriter.writeRoomMeta(roomname, room, true, true); err != nil {
+		room.tiered = false
+		return false, err
+	}
+	room.metaDirty = false
+	if err = store.Truncate(roomname, 0); err != nil {
+		return true, err
+	}
+	return true, store.Sync(roomname)
+}
+
+// rehydrateRoom restores the content of a tiered room from the blob store.
+// Expects room.mux to be locked.
+func (fswriter *fswriter) rehydrateRoom(roomname protocol.Roomname, room *room) error {
+	if fswriter.blobs == nil {
+		return fmt.Errorf("room %s is tiered, but no blob store is configured", roomname)
+	}
+	key := roomBlobKey(roomname)
+	data, err := fswriter.blobs.Get(key)
+	if err != nil {
+		return err
+	}
+	if uint32(len(data)) != room.offset {
+		return fmt.Errorf("room %s: blob has %d bytes, expected %d", roomname, len(data), room.offset)
+	}
+	store := fswriter.storage
+	// the storage may contain a partial rehydration or replayed appends
+	if err = store.Truncate(roomname, 0); err != nil {
+		return err
+	}
+	if err = store.Append(roomname, data); err != nil {
+		return err
+	}
+	if err = store.Sync(roomname); err != nil {
+		return err
+	}
+	room.tiered = false
+	if err = fswriter.writeRoomMeta(roomname, room, true, true); err != nil {
+		// the room is rehydrated again, as the meta still marks it as tiered
+		room.tiered = true
+		return err
+	}
+	if err = fswriter.blobs.Delete(key); err != nil {
+		debug(fmt.Sprintf("tiering: unable to delete blob of room %s: %s", roomname, err))
+	}
+	return nil
+}
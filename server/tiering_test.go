@@ -0,0 +1,69 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jwmdev/ydb/storage"
+)
+
+// TestTiering tests that idle rooms are moved to the blob store and evicted, and rehydrated when they are
+// modified again.
+func TestTiering(t *testing.T) {
+	dir := "_test_tiering"
+	blobDir := "_test_tiering_blobs"
+	os.RemoveAll(dir)
+	os.RemoveAll(blobDir)
+	defer os.RemoveAll(dir)
+	defer os.RemoveAll(blobDir)
+	blobs, err := storage.NewDirBlobStore(blobDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ydb := newTestYdb(t, dir)
+	if err := ydb.StartTiering(time.Hour, time.Hour); err == nil {
+		t.Error("expected tiering to require a blob store")
+	}
+	ydb.fswriter.blobs = blobs
+	session := newSession(ydb, 1)
+	ydb.updateRoom(testroom, session, 0, []byte{1, 2, 3})
+	waitForRoomPersisted(ydb, testroom)
+	rsid := ydb.getRoom(testroom).roomsessionid
+	if n, err := ydb.tierIdleRooms(0); n != 1 || err != nil {
+		t.Fatalf("expected to tier 1 room, tiered %d (error: %v)", n, err)
+	}
+	if _, cached := ydb.rooms.lookup(testroom); cached {
+		t.Error("expected tiered room to be evicted")
+	}
+	if size, _ := ydb.fswriter.storage.Size(testroom); size != 0 {
+		t.Errorf("expected tiered room to have no local content, got size %d", size)
+	}
+	if _, err := blobs.Get(roomBlobKey(testroom)); err != nil {
+		t.Errorf("expected blob of tiered room: %s", err)
+	}
+	ydb.Close()
+
+	ydb = newTestYdb(t, dir)
+	ydb.fswriter.blobs = blobs
+	session = newSession(ydb, 1)
+	room := ydb.getRoom(testroom)
+	if !room.tiered || room.offset != 3 || room.roomsessionid != rsid {
+		t.Errorf("expected tiered room with offset 3 and rsid %d, got tiered=%v offset %d rsid %d", rsid, room.tiered, room.offset, room.roomsessionid)
+	}
+	ydb.updateRoom(testroom, session, 1, []byte{4})
+	waitForRoomPersisted(ydb, testroom)
+	r, _ := ydb.fswriter.storage.ReadFrom(testroom, 0)
+	data, _ := ioutil.ReadAll(r)
+	r.Close()
+	if !bytes.Equal(data, []byte{1, 2, 3, 4}) {
+		t.Errorf("expected rehydrated room content [1 2 3 4], got %v", data)
+	}
+	if _, err := blobs.Get(roomBlobKey(testroom)); !os.IsNotExist(err) {
+		t.Error("expected blob to be deleted after rehydration")
+	}
+	ydb.Close()
+}
@@ -1,13 +1,17 @@
-package main
+package server
 
 import (
 	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/jwmdev/ydb/protocol"
 )
 
 const (
@@ -20,8 +24,11 @@ const (
 	// Send pings to peer with this period. Must be less than pongWait.
 	pingPeriod = (pongWait * 9) / 10
 
-	// Maximum message size allowed from peer.
-	maxMessageSize = 10000000
+	// Time allowed to write the close frame before the connection is closed.
+	closeWait = time.Second
+
+	// Control frames carry at most 125 bytes, two of them are used by the close code.
+	maxCloseReasonLen = 123
 )
 
 var upgrader = websocket.Upgrader{
@@ -56,11 +63,24 @@ func (wsConn *wsConn) WriteMessage(m []byte, pm *websocket.PreparedMessage) {
 		recover() // recover if channel is already closed
 	}()
 	debugMessageType("sending message to client..", m)
-	wsConn.send <- pm
+	select {
+	case wsConn.send <- pm:
+	case <-wsConn.closeWritePump:
+	}
+}
+
+// Close sends a close frame and closes the underlying connection. The read pump and the write pump end,
+// and the conn is removed from the session.
+func (wsConn *wsConn) Close(code int, reason string) {
+	if len(reason) > maxCloseReasonLen {
+		reason = reason[:maxCloseReasonLen]
+	}
+	wsConn.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(closeWait))
+	wsConn.conn.Close()
 }
 
 func (wsConn *wsConn) readPump() {
-	wsConn.conn.SetReadLimit(maxMessageSize)
+	wsConn.conn.SetReadLimit(protocol.MaxMessageSize)
 	wsConn.conn.SetReadDeadline(time.Now().Add(pongWait))
 	wsConn.conn.SetPongHandler(func(string) error {
 		wsConn.conn.SetReadDeadline(time.Now().Add(pongWait))
@@ -74,9 +94,25 @@ func (wsConn *wsConn) readPump() {
 			}
 			break
 		}
+		if wsConn.session.ydb.shuttingDown() {
+			// the client sends unconfirmed messages again when it reconnects
+			continue
+		}
 		mbuffer := bytes.NewBuffer(message)
 		for {
 			err := readMessage(mbuffer, wsConn.session)
+			if cerr, ok := err.(*closeError); ok {
+				log.Printf("ydb error: closing conn of session %d: %s", wsConn.session.sessionid, cerr.reason)
+				if cerr.code == protocol.CloseProtocolViolation {
+					wsConn.session.sendError(protocol.Error{Code: protocol.ErrorMalformedMessage, Text: cerr.reason})
+					// give the send task a chance to deliver the error before the conn is closed
+					ctx, cancel := context.WithTimeout(context.Background(), closeWait)
+					waitUntil(ctx, wsConn.session.drained)
+					cancel()
+				}
+				// the next read fails and ends the read pump
+				wsConn.Close(cerr.code, cerr.reason)
+			}
 			if err != nil {
 				break
 			}
@@ -123,14 +159,36 @@ func (wsConn *wsConn) writePump() {
 	}
 }
 
-func setupWebsocketsListener(addr string) {
-	// TODO: only set this if in testing mode!
-	http.HandleFunc("/clearAll", func(w http.ResponseWriter, r *http.Request) {
-		unsafeClearAllYdbContent()
-		w.WriteHeader(200)
-		fmt.Fprintf(w, "OK")
+// isTrustedRequest checks whether the request authenticates with the admin token ("Authorization: Bearer <token>").
+func (ydb *Ydb) isTrustedRequest(r *http.Request) bool {
+	if ydb.adminToken == "" {
+		return false
+	}
+	auth := []byte(r.Header.Get("Authorization"))
+	return subtle.ConstantTimeCompare(auth, []byte("Bearer "+ydb.adminToken)) == 1
+}
+
+// MetricsHandler serves the metrics of ydb as JSON, e.g. the number of slow consumers. Requests are not
+// authenticated, so it should not be mounted on a public address.
+func (ydb *Ydb) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"slowConsumers": ydb.slowConsumerMetrics.snapshot(),
+		})
 	})
-	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+}
+
+// Handler serves the websocket endpoint of ydb at /ws. It can be mounted on any mux, e.g.
+//
+//	http.Handle("/ydb/", http.StripPrefix("/ydb", ydb.Handler()))
+func (ydb *Ydb) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		if ydb.shuttingDown() {
+			http.Error(w, "ydb is shutting down", http.StatusServiceUnavailable)
+			return
+		}
 		fmt.Println("new client..")
 		conn, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
@@ -144,13 +202,13 @@ func setupWebsocketsListener(addr string) {
 		} else {
 			session = ydb.getSession(sessionid)
 		}
+		if ydb.isTrustedRequest(r) {
+			session.trusted = true
+		}
 		wsConn := newWsConn(session, conn)
 		session.add(wsConn)
 		go wsConn.readPump()
 		go wsConn.writePump()
 	})
-	err := http.ListenAndServe(addr, nil)
-	if err != nil {
-		exitBecause(err.Error())
-	}
+	return mux
 }
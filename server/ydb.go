@@ -0,0 +1,231 @@
+// Package server implements the Ydb server. Create an instance with New and mount its Handler on an http server.
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/jwmdev/ydb/protocol"
+	"github.com/jwmdev/ydb/storage"
+)
+
+// Ydb maintains rooms and connections. Create instances with New. Several instances can run in one process,
+// as long as they use different directories.
+type Ydb struct {
+	// first field, so that the counters are 64-bit aligned for atomic access
+	slowConsumerMetrics slowConsumerMetrics
+	rooms               *roomRegistry
+	// maximum number of cached rooms. Unbounded if zero
+	maxRooms int
+	// TODO: use guid instead of uint64
+	sessionsMux sync.Mutex
+	sessions    map[uint64]*session
+	fswriter    *fswriter
+	durability  DurabilityConfig
+	// clients that authenticate with the admin token may compact rooms. Empty if disabled
+	adminToken string
+	// maximum size of the updates that are sent to subscribers that catch up with a room (see fswriter.sendRoomTail)
+	syncChunkSize int
+	// limits the outbox of sessions
+	slowConsumer SlowConsumerConfig
+	// clients with an older protocol version are rejected
+	minProtocolVersion uint64
+	seed               *rand.Rand
+	seedMux            sync.Mutex
+	// set by Shutdown. Accessed atomically
+	closing int32
+	// closed by Close to stop background tasks (e.g. tiering)
+	closed     chan struct{}
+	background sync.WaitGroup
+	closeOnce  sync.Once
+}
+
+// Options configure a Ydb instance. The zero value of an option selects its default.
+type Options struct {
+	// directory that is used to persist data. Not used by the memory storage
+	Dir string
+	// storage backend: storage.KindFile (default), storage.KindMemory, or storage.KindBolt
+	Storage string
+	// number of rooms that are persisted in parallel. At least 1
+	WriteConcurrency int
+	// defaults to protocol.DurabilityFsync
+	Durability DurabilityConfig
+	AdminToken string
+	// defaults to DefaultSyncChunkSize
+	SyncChunkSize int
+	MaxRooms      int
+	SlowConsumer  SlowConsumerConfig
+	// clients with an older protocol version are rejected. protocol.VersionLegacy (default) accepts clients
+	// that don't send a hello
+	MinProtocolVersion uint64
+	// blob store that tiered rooms are rehydrated from. nil if tiering is disabled
+	Blobs storage.BlobStore
+}
+
+func (ydb *Ydb) genUint32() uint32 {
+	ydb.seedMux.Lock()
+	n := ydb.seed.Uint32()
+	ydb.seedMux.Unlock()
+	return n
+}
+
+func (ydb *Ydb) genUint64() uint64 {
+	ydb.seedMux.Lock()
+	n := ydb.seed.Uint64()
+	ydb.seedMux.Unlock()
+	return n
+}
+
+// New opens the storage, repairs it, and loads the room index.
+func New(options Options) (*Ydb, error) {
+	if options.Storage == "" {
+		options.Storage = storage.KindFile
+	}
+	if options.Durability.Level == 0 {
+		options.Durability.Level = protocol.DurabilityFsync
+	}
+	if options.SyncChunkSize <= 0 {
+		options.SyncChunkSize = DefaultSyncChunkSize
+	}
+	if options.SlowConsumer.MaxMessages == 0 {
+		options.SlowConsumer.MaxMessages = DefaultOutboxMaxMessages
+	}
+	if options.SlowConsumer.MaxBytes == 0 {
+		options.SlowConsumer.MaxBytes = DefaultOutboxMaxBytes
+	}
+	if options.SlowConsumer.Policy == 0 {
+		options.SlowConsumer.Policy = SlowConsumerResubscribe
+	}
+	if options.MinProtocolVersion > protocol.Version {
+		return nil, fmt.Errorf("minimum protocol version %d is newer than the protocol version %d", options.MinProtocolVersion, protocol.Version)
+	}
+	store, err := storage.Open(options.Storage, options.Dir)
+	if err != nil {
+		return nil, err
+	}
+	// repair torn appends before the write-ahead log is replayed on top of them
+	corrupted, err := store.Recover()
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	for _, roomname := range corrupted {
+		fmt.Printf("ydb error: room %s is corrupted\n", roomname)
+	}
+	// only the file storage needs a write-ahead log to make appends durable
+	walDir := ""
+	if options.Storage == storage.KindFile {
+		walDir = filepath.Join(options.Dir, storage.WALDirname)
+	}
+	// the memory storage starts empty, so the room index must not be persisted
+	indexPath := ""
+	if options.Storage != storage.KindMemory {
+		indexPath = filepath.Join(options.Dir, indexFilename)
+	}
+	// remember to update unsafeClearAllContent when updating here
+	ydb := &Ydb{
+		sessions:           make(map[uint64]*session),
+		maxRooms:           options.MaxRooms,
+		durability:         options.Durability,
+		adminToken:         options.AdminToken,
+		syncChunkSize:      options.SyncChunkSize,
+		slowConsumer:       options.SlowConsumer,
+		minProtocolVersion: options.MinProtocolVersion,
+		seed:               rand.New(rand.NewSource(time.Now().UnixNano())),
+		closed:             make(chan struct{}),
+	}
+	ydb.rooms = newRoomRegistry(roomStripes, ydb.newRoom)
+	if ydb.fswriter, err = newFSWriter(ydb, store, walDir, indexPath, 1000, options.WriteConcurrency); err != nil {
+		store.Close()
+		return nil, err
+	}
+	ydb.fswriter.blobs = options.Blobs
+	// the index is loaded after the write-ahead log was replayed
+	if err = ydb.fswriter.index.load(store, ydb.genUint32); err != nil {
+		ydb.fswriter.stop()
+		store.Close()
+		return nil, err
+	}
+	return ydb, nil
+}
+
+// getRoom is safe for parallel access.
+func (ydb *Ydb) getRoom(name protocol.Roomname) *room {
+	r, created := ydb.rooms.getOrCreate(name, func(r *room) {
+		if meta, ok := ydb.fswriter.index.get(name); ok {
+			r.offset = meta.Offset
+			r.roomsessionid = meta.Rsid
+			r.created = meta.Created
+			r.modified = meta.Modified
+			r.tiered = meta.Tiered
+		}
+		r.durability = ydb.durability.forRoom(name)
+	})
+	if created {
+		ydb.evictIdleRooms(ydb.rooms.stripe(name), r)
+	}
+	return r
+}
+
+func (ydb *Ydb) getSession(sessionid uint64) *session {
+	ydb.sessionsMux.Lock()
+	defer ydb.sessionsMux.Unlock()
+	return ydb.sessions[sessionid]
+}
+
+func (ydb *Ydb) createSession() (s *session) {
+	ydb.sessionsMux.Lock()
+	sessionid := ydb.genUint64()
+	if _, ok := ydb.sessions[sessionid]; ok {
+		panic("Generated the same session id twice! (this is a security vulnerability)")
+	}
+	s = newSession(ydb, sessionid)
+	ydb.sessions[sessionid] = s
+	ydb.sessionsMux.Unlock()
+	return s
+}
+
+func (ydb *Ydb) removeSession(sessionid uint64) (err error) {
+	ydb.sessionsMux.Lock()
+	session, ok := ydb.sessions[sessionid]
+	if !ok {
+		err = fmt.Errorf("tried to close session %d, but session does not exist", sessionid)
+	} else if len(session.conns) > 0 || session.conn != nil {
+		err = errors.New("Cannot close this session because conns are still using it")
+	} else {
+		delete(ydb.sessions, sessionid)
+	}
+	ydb.sessionsMux.Unlock()
+	return
+}
+
+// Close stops the background tasks and the write tasks. It marks all rooms as cleanly closed, so they keep their
+// roomsessionid when Ydb is started again. Rooms that still have data to persist are not marked. The room index is
+// only saved if all rooms are clean. Closes the write-ahead log and the storage. Calling Close again has no effect.
+func (ydb *Ydb) Close() {
+	ydb.closeOnce.Do(ydb.close)
+}
+
+func (ydb *Ydb) close() {
+	close(ydb.closed)
+	ydb.background.Wait()
+	ydb.fswriter.stop()
+	clean := true
+	for name, room := range ydb.rooms.snapshot() {
+		room.mux.Lock()
+		if !room.evicted && !ydb.fswriter.closeRoomMeta(name, room) {
+			clean = false
+		}
+		room.mux.Unlock()
+	}
+	if clean {
+		if err := ydb.fswriter.index.save(); err != nil {
+			fmt.Printf("ydb error: unable to save the room index: %s\n", err)
+		}
+	}
+	ydb.fswriter.storage.Close()
+}
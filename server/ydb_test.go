@@ -0,0 +1,183 @@
+package server
+
+import (
+	"math/rand"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jwmdev/ydb/protocol"
+	"github.com/jwmdev/ydb/storage"
+)
+
+// newTestYdb opens an instance in dir with the file storage and protocol.DurabilityFsync.
+func newTestYdb(t testing.TB, dir string) *Ydb {
+	ydb, err := New(Options{
+		Dir:              dir,
+		Storage:          storage.KindFile,
+		WriteConcurrency: 2,
+		Durability:       DurabilityConfig{Level: protocol.DurabilityFsync},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ydb
+}
+
+const testroom = "testroom"
+
+func createYdbTest(f func(ydb *Ydb)) {
+	dir := "_test"
+	os.RemoveAll(dir)
+	ydb, err := New(Options{Dir: dir, WriteConcurrency: 10, Durability: DurabilityConfig{Level: protocol.DurabilityFsync}})
+	if err != nil {
+		panic(err)
+	}
+	f(ydb)
+	os.RemoveAll(dir)
+}
+
+// testGetRoom test if getRoom is safe for parallel access
+func TestGetRoom(t *testing.T) {
+	createYdbTest(func(ydb *Ydb) {
+		runTest := func(seed int, wg *sync.WaitGroup) {
+			src := rand.NewSource(int64(seed))
+			r := rand.New(src)
+			var numOfTests uint64 = 10000
+			var i uint64
+			for ; i < numOfTests; i++ {
+				roomname := protocol.Roomname(strconv.FormatUint(r.Uint64()%numOfTests, 10))
+				ydb.getRoom(roomname)
+			}
+			wg.Done()
+		}
+		p := 100
+		wg := new(sync.WaitGroup)
+		wg.Add(p)
+		for i := 0; i < p; i++ {
+			go runTest(i, wg)
+		}
+		wg.Wait()
+	})
+}
+
+// waitForRoomPersisted waits until the fswriter persisted all pending writes of a room
+func waitForRoomPersisted(ydb *Ydb, name protocol.Roomname) {
+	room := ydb.getRoom(name)
+	for {
+		room.mux.Lock()
+		persisted := !room.registered && len(room.pendingWrites) == 0
+		room.mux.Unlock()
+		if persisted {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+// waitForDelivery waits until the send task of s delivered all queued messages.
+func waitForDelivery(s *session) {
+	for {
+		s.mux.Lock()
+		delivered := len(s.outbox) == 0 && !s.delivering
+		s.mux.Unlock()
+		if delivered {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+// TestRoomsessionidAfterRestart tests that a room keeps its roomsessionid after a clean restart,
+// and that the roomsessionid changes if Ydb was not closed cleanly.
+func TestRoomsessionidAfterRestart(t *testing.T) {
+	dir := "_test_restart"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+
+	ydb := newTestYdb(t, dir)
+	session := newSession(ydb, 1)
+	ydb.updateRoom(testroom, session, 0, []byte{1, 2, 3})
+	waitForRoomPersisted(ydb, testroom)
+	rsid := ydb.getRoom(testroom).roomsessionid
+	ydb.Close()
+
+	ydb = newTestYdb(t, dir)
+	session = newSession(ydb, 1)
+	room := ydb.getRoom(testroom)
+	if room.roomsessionid != rsid || room.offset != 3 {
+		t.Errorf("expected rsid %d and offset 3 after clean restart, got rsid %d and offset %d", rsid, room.roomsessionid, room.offset)
+	}
+	ydb.updateRoom(testroom, session, 1, []byte{4})
+	waitForRoomPersisted(ydb, testroom)
+	// not closed cleanly
+
+	ydb = newTestYdb(t, dir)
+	room = ydb.getRoom(testroom)
+	if room.roomsessionid == rsid || room.offset != 4 {
+		t.Errorf("expected a new rsid and offset 4 after unclean restart, got rsid %d and offset %d", room.roomsessionid, room.offset)
+	}
+}
+
+// TestMultipleInstances tests that instances in one process don't share rooms.
+func TestMultipleInstances(t *testing.T) {
+	dir1 := "_test_instance1"
+	dir2 := "_test_instance2"
+	os.RemoveAll(dir1)
+	os.RemoveAll(dir2)
+	defer os.RemoveAll(dir1)
+	defer os.RemoveAll(dir2)
+	ydb1 := newTestYdb(t, dir1)
+	defer ydb1.Close()
+	ydb2 := newTestYdb(t, dir2)
+	defer ydb2.Close()
+	ydb1.updateRoom(testroom, newSession(ydb1, 1), 0, []byte{1, 2, 3})
+	ydb2.updateRoom(testroom, newSession(ydb2, 1), 0, []byte{4})
+	waitForRoomPersisted(ydb1, testroom)
+	waitForRoomPersisted(ydb2, testroom)
+	if offset := ydb1.getRoom(testroom).offset; offset != 3 {
+		t.Errorf("expected room of the first instance to have offset 3, got %d", offset)
+	}
+	if offset := ydb2.getRoom(testroom).offset; offset != 1 {
+		t.Errorf("expected room of the second instance to have offset 1, got %d", offset)
+	}
+	if size, _ := ydb2.fswriter.storage.Size(testroom); size != 1 {
+		t.Errorf("expected the second instance to persist 1 byte, got %d", size)
+	}
+}
+
+// TestCloseStopsTasks tests that Close stops the write tasks, the write-ahead log, and tiering, so that instances
+// don't leak goroutines.
+func TestCloseStopsTasks(t *testing.T) {
+	dir := "_test_close"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	before := runtime.NumGoroutine()
+	ydb := newTestYdb(t, dir)
+	ydb.StartTiering(time.Hour, time.Millisecond)
+	ydb.updateRoom(testroom, newSession(ydb, 1), 0, []byte{1, 2, 3})
+	waitForRoomPersisted(ydb, testroom)
+	ydb.Close()
+	ydb.Close()
+	waitFor(t, "the goroutines of the instance to end", func() bool {
+		return runtime.NumGoroutine() <= before
+	})
+}
+
+// Clear all content in Ydb (files, sessions, rooms, ..).
+// Unsafe for production, only use for testing!
+// only works if dir is tmp
+func (ydb *Ydb) unsafeClearAllContent() {
+	debug("Clear Ydb content")
+	ydb.rooms = newRoomRegistry(roomStripes, ydb.newRoom)
+	ydb.sessions = make(map[uint64]*session)
+	store := ydb.fswriter.storage
+	roomnames, _ := store.List()
+	for _, roomname := range roomnames {
+		store.Delete(roomname)
+		ydb.fswriter.index.remove(roomname)
+	}
+}
@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// BlobStore is an object storage that cold rooms are moved to (see tiering in package server).
+type BlobStore interface {
+	// Put stores the size bytes that r yields. Fails if r ends early
+	Put(key string, r io.Reader, size int64) error
+	Get(key string) ([]byte, error)
+	Delete(key string) error
+}
+
+// dirBlobStore stores blobs as files in a directory. Useful for testing, or for mounted network storage.
+type dirBlobStore struct {
+	dir string
+}
+
+func NewDirBlobStore(dir string) (*dirBlobStore, error) {
+	if err := os.MkdirAll(dir, dirPerms); err != nil {
+		return nil, err
+	}
+	return &dirBlobStore{dir}, nil
+}
+
+func (store *dirBlobStore) Put(key string, r io.Reader, size int64) error {
+	path := filepath.Join(store.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), dirPerms); err != nil {
+		return err
+	}
+	// write to a temporary file first, so that a blob is never partially written
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, stdPerms)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, io.LimitReader(r, size))
+	if err == nil && n != size {
+		err = fmt.Errorf("blob %s: expected %d bytes, got %d", key, size, n)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func (store *dirBlobStore) Get(key string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(store.dir, filepath.FromSlash(key)))
+}
+
+func (store *dirBlobStore) Delete(key string) error {
+	err := os.Remove(filepath.Join(store.dir, filepath.FromSlash(key)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// s3BlobStore stores blobs in a bucket of an S3-compatible object storage.
+type s3BlobStore struct {
+	client *minio.Client
+	bucket string
+}
+
+func NewS3BlobStore(endpoint string, accessKey string, secretKey string, bucket string, secure bool) (*s3BlobStore, error) {
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(accessKey, secretKey, ""),
+		Secure: secure,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	exists, err := client.BucketExists(ctx, bucket)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		if err = client.MakeBucket(ctx, bucket, minio.MakeBucketOptions{}); err != nil {
+			return nil, err
+		}
+	}
+	return &s3BlobStore{client, bucket}, nil
+}
+
+func (store *s3BlobStore) Put(key string, r io.Reader, size int64) error {
+	_, err := store.client.PutObject(context.Background(), store.bucket, key, r, size, minio.PutObjectOptions{
+		ContentType: "application/octet-stream",
+	})
+	return err
+}
+
+func (store *s3BlobStore) Get(key string) ([]byte, error) {
+	obj, err := store.client.GetObject(context.Background(), store.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+	return ioutil.ReadAll(obj)
+}
+
+func (store *s3BlobStore) Delete(key string) error {
+	return store.client.RemoveObject(context.Background(), store.bucket, key, minio.RemoveObjectOptions{})
+}
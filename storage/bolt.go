@@ -0,0 +1,222 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/jwmdev/ydb/protocol"
+)
+
+var (
+	boltRoomsBucket = []byte("rooms")
+	boltMetaBucket  = []byte("meta")
+)
+
+// boltStorage stores rooms in an embedded key-value store.
+// Each room is a bucket in the rooms bucket. Appends are stored as separate values keyed by their offset,
+// so that appending does not rewrite the content of a room.
+// Every transaction is fsynced. Concurrent appends are committed in a single transaction (see bolt.DB.Batch).
+type boltStorage struct {
+	db *bolt.DB
+}
+
+func newBoltStorage(path string) (*boltStorage, error) {
+	db, err := bolt.Open(path, stdPerms, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(boltRoomsBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(boltMetaBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStorage{db}, nil
+}
+
+// boltRoomKey prefixes room names, because bolt does not support empty keys.
+func boltRoomKey(roomname protocol.Roomname) []byte {
+	return append([]byte{'r'}, roomname...)
+}
+
+func boltOffsetKey(offset uint32) []byte {
+	key := make([]byte, 4)
+	binary.BigEndian.PutUint32(key, offset)
+	return key
+}
+
+func boltRoomSize(b *bolt.Bucket) uint32 {
+	if b == nil {
+		return 0
+	}
+	k, v := b.Cursor().Last()
+	if k == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(k) + uint32(len(v))
+}
+
+func (storage *boltStorage) Append(roomname protocol.Roomname, data []byte) error {
+	return storage.db.Batch(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(boltRoomsBucket).CreateBucketIfNotExists(boltRoomKey(roomname))
+		if err != nil {
+			return err
+		}
+		return b.Put(boltOffsetKey(boltRoomSize(b)), data)
+	})
+}
+
+func (storage *boltStorage) ReadFrom(roomname protocol.Roomname, offset uint32) (io.ReadCloser, error) {
+	buf := &bytes.Buffer{}
+	err := storage.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltRoomsBucket).Bucket(boltRoomKey(roomname))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		// find the append that contains offset
+		k, v := c.Seek(boltOffsetKey(offset))
+		if k == nil {
+			k, v = c.Last()
+		} else if binary.BigEndian.Uint32(k) > offset {
+			if pk, pv := c.Prev(); pk != nil {
+				k, v = pk, pv
+			} else {
+				k, v = c.First()
+			}
+		}
+		for ; k != nil; k, v = c.Next() {
+			start := binary.BigEndian.Uint32(k)
+			if start < offset {
+				if start+uint32(len(v)) <= offset {
+					continue
+				}
+				v = v[offset-start:]
+			}
+			// values are only valid during the transaction
+			buf.Write(v)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(buf), nil
+}
+
+func (storage *boltStorage) Size(roomname protocol.Roomname) (size uint32, err error) {
+	err = storage.db.View(func(tx *bolt.Tx) error {
+		size = boltRoomSize(tx.Bucket(boltRoomsBucket).Bucket(boltRoomKey(roomname)))
+		return nil
+	})
+	return
+}
+
+func (storage *boltStorage) Replace(roomname protocol.Roomname, data []byte) error {
+	return storage.db.Update(func(tx *bolt.Tx) error {
+		rooms := tx.Bucket(boltRoomsBucket)
+		key := boltRoomKey(roomname)
+		if err := rooms.DeleteBucket(key); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		b, err := rooms.CreateBucket(key)
+		if err != nil || len(data) == 0 {
+			return err
+		}
+		return b.Put(boltOffsetKey(0), data)
+	})
+}
+
+func (storage *boltStorage) Truncate(roomname protocol.Roomname, size uint32) error {
+	return storage.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltRoomsBucket).Bucket(boltRoomKey(roomname))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Last() {
+			start := binary.BigEndian.Uint32(k)
+			if start+uint32(len(v)) <= size {
+				break
+			}
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+			if start < size {
+				// keep the part of the append that is before size
+				if err := b.Put(boltOffsetKey(start), append([]byte(nil), v[:size-start]...)); err != nil {
+					return err
+				}
+				break
+			}
+		}
+		return nil
+	})
+}
+
+// Recover does nothing, because bolt transactions are atomic, so appends can not be torn.
+func (storage *boltStorage) Recover() ([]protocol.Roomname, error) {
+	return nil, nil
+}
+
+// Sync does nothing, because bolt transactions are already durable when they are committed.
+func (storage *boltStorage) Sync(roomname protocol.Roomname) error {
+	return nil
+}
+
+func (storage *boltStorage) Delete(roomname protocol.Roomname) error {
+	return storage.db.Update(func(tx *bolt.Tx) error {
+		key := boltRoomKey(roomname)
+		if err := tx.Bucket(boltRoomsBucket).DeleteBucket(key); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		return tx.Bucket(boltMetaBucket).Delete(key)
+	})
+}
+
+func (storage *boltStorage) List() (roomnames []protocol.Roomname, err error) {
+	err = storage.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltMetaBucket).ForEach(func(k, v []byte) error {
+			roomnames = append(roomnames, protocol.Roomname(k[1:]))
+			return nil
+		})
+	})
+	return
+}
+
+func (storage *boltStorage) ReadMeta(roomname protocol.Roomname) (meta RoomMeta, ok bool, err error) {
+	err = storage.db.View(func(tx *bolt.Tx) error {
+		bs := tx.Bucket(boltMetaBucket).Get(boltRoomKey(roomname))
+		if bs == nil {
+			return nil
+		}
+		ok = true
+		return json.Unmarshal(bs, &meta)
+	})
+	return
+}
+
+func (storage *boltStorage) WriteMeta(roomname protocol.Roomname, meta RoomMeta, sync bool) error {
+	bs, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return storage.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltMetaBucket).Put(boltRoomKey(roomname), bs)
+	})
+}
+
+func (storage *boltStorage) Close() error {
+	return storage.db.Close()
+}
@@ -0,0 +1,332 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jwmdev/ydb/protocol"
+)
+
+const (
+	stdPerms = 0600
+	// must include x permission for user, otherwise user can't write files
+	dirPerms     = stdPerms | 0100
+	roomsDirname = "rooms"
+	metaSuffix   = ".meta"
+)
+
+// fileStorage stores each room as an append-only file of checksummed frames (see frame.go).
+// The meta of a room is stored next to the room file.
+type fileStorage struct {
+	dir string
+}
+
+// newFileStorage migrates rooms of earlier versions to the current layout (see migrateLegacyRooms).
+func newFileStorage(dir string) (*fileStorage, error) {
+	if err := os.MkdirAll(dir, dirPerms); err != nil {
+		return nil, err
+	}
+	storage := &fileStorage{dir}
+	if err := migrateLegacyRooms(storage); err != nil {
+		return nil, fmt.Errorf("unable to migrate the rooms in %s: %s", dir, err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, roomsDirname), dirPerms); err != nil {
+		return nil, err
+	}
+	return storage, nil
+}
+
+// openExistingFileStorage opens the file storage without modifying dir. Fails if the rooms must be migrated.
+func openExistingFileStorage(dir string) (*fileStorage, error) {
+	roomnames, _, err := findLegacyRooms(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(roomnames) > 0 {
+		return nil, fmt.Errorf("the rooms in %s were stored by an earlier version, start ydb once to migrate them", dir)
+	}
+	return &fileStorage{dir}, nil
+}
+
+// roomFilePath maps a room to a file in dir. Room names are chosen by clients, so they are never used as file names.
+// The file is named after the hash of the room name, and distributed over two levels of sub-directories
+// so that a single directory does not hold millions of files (e.g. rooms/9f/86/9f86d0..).
+// The original room name is stored in the meta of the room (see roomMetaPath).
+func roomFilePath(dir string, roomname protocol.Roomname) string {
+	h := sha256.Sum256([]byte(roomname))
+	name := hex.EncodeToString(h[:])
+	return filepath.Join(dir, roomsDirname, name[0:2], name[2:4], name)
+}
+
+func roomMetaPath(dir string, roomname protocol.Roomname) string {
+	return roomFilePath(dir, roomname) + metaSuffix
+}
+
+// openFile opens a room file and creates the parent directories if necessary.
+func openFile(path string, flag int) (*os.File, error) {
+	f, err := os.OpenFile(path, flag, stdPerms)
+	if os.IsNotExist(err) && flag&os.O_CREATE != 0 {
+		if err = os.MkdirAll(filepath.Dir(path), dirPerms); err != nil {
+			return nil, err
+		}
+		f, err = os.OpenFile(path, flag, stdPerms)
+	}
+	return f, err
+}
+
+func (storage *fileStorage) Append(roomname protocol.Roomname, data []byte) error {
+	f, err := openFile(roomFilePath(storage.dir, roomname), os.O_APPEND|os.O_WRONLY|os.O_CREATE)
+	if err != nil {
+		return err
+	}
+	// a single write, so that an interrupted append only tears the last frame
+	_, err = f.Write(createFrame(data))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (storage *fileStorage) ReadFrom(roomname protocol.Roomname, offset uint32) (io.ReadCloser, error) {
+	f, err := os.Open(roomFilePath(storage.dir, roomname))
+	if os.IsNotExist(err) {
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newFrameReader(f, offset), nil
+}
+
+// Size sums up the lengths of all complete frames. Checksums are not verified.
+func (storage *fileStorage) Size(roomname protocol.Roomname) (uint32, error) {
+	f, err := os.Open(roomFilePath(storage.dir, roomname))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	scan, err := scanFrames(f, false)
+	return scan.size, err
+}
+
+// Replace writes data to a temporary file that is renamed to the room file.
+func (storage *fileStorage) Replace(roomname protocol.Roomname, data []byte) error {
+	path := roomFilePath(storage.dir, roomname)
+	tmpPath := path + ".tmp"
+	f, err := openFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	if len(data) > 0 {
+		_, err = f.Write(createFrame(data))
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	return SyncDir(filepath.Dir(path))
+}
+
+// Truncate cuts the room file at the frame that contains size. If size is within the frame,
+// the remaining part of the frame is appended as a new frame.
+func (storage *fileStorage) Truncate(roomname protocol.Roomname, size uint32) error {
+	f, err := os.OpenFile(roomFilePath(storage.dir, roomname), os.O_RDWR, stdPerms)
+	if os.IsNotExist(err) && size == 0 {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	pos, start, err := findFrame(f, size)
+	if err != nil {
+		return err
+	}
+	var keep []byte
+	if start < size {
+		if _, err = f.Seek(pos, io.SeekStart); err != nil {
+			return err
+		}
+		keep = make([]byte, size-start)
+		if _, err = io.ReadFull(newFrameReader(f, 0), keep); err != nil {
+			return err
+		}
+	}
+	if err = f.Truncate(pos); err != nil {
+		return err
+	}
+	if len(keep) > 0 {
+		_, err = f.WriteAt(createFrame(keep), pos)
+	}
+	return err
+}
+
+// Recover truncates torn frames at the end of room files, which are left by appends that were interrupted by a crash.
+// Rooms with invalid frames before the end are not modified, they are reported as corrupted.
+// Only rooms whose meta is not marked clean are scanned, because the content of clean rooms was synced before
+// the meta was written.
+func (storage *fileStorage) Recover() (corrupted []protocol.Roomname, err error) {
+	metas, err := storage.listMetas()
+	if err != nil {
+		return
+	}
+	for _, meta := range metas {
+		if meta.Clean {
+			continue
+		}
+		roomname := meta.Name
+		f, err := os.OpenFile(roomFilePath(storage.dir, roomname), os.O_RDWR, stdPerms)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return corrupted, err
+		}
+		scan, err := scanFrames(f, true)
+		if err == nil && scan.err != nil {
+			if scan.torn {
+				debug(fmt.Sprintf("storage: truncating torn frame of room %s at %d (%s)", roomname, scan.end, scan.err))
+				if err = f.Truncate(scan.end); err == nil {
+					err = f.Sync()
+				}
+			} else {
+				corrupted = append(corrupted, roomname)
+			}
+		}
+		f.Close()
+		if err != nil {
+			return corrupted, err
+		}
+	}
+	return
+}
+
+func (storage *fileStorage) Sync(roomname protocol.Roomname) error {
+	return syncFile(roomFilePath(storage.dir, roomname))
+}
+
+func syncFile(path string) error {
+	f, err := os.OpenFile(path, os.O_RDONLY, stdPerms)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// SyncDir persists renames and removals of files in dir.
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (storage *fileStorage) Delete(roomname protocol.Roomname) error {
+	for _, path := range []string{roomFilePath(storage.dir, roomname), roomMetaPath(storage.dir, roomname)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// List walks the meta files, which serve as the reverse index from room files to room names.
+func (storage *fileStorage) List() (roomnames []protocol.Roomname, err error) {
+	metas, err := storage.listMetas()
+	for _, meta := range metas {
+		roomnames = append(roomnames, meta.Name)
+	}
+	return
+}
+
+func (storage *fileStorage) listMetas() (metas []RoomMeta, err error) {
+	err = filepath.Walk(filepath.Join(storage.dir, roomsDirname), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(path, metaSuffix) {
+			return nil
+		}
+		meta, ok := readRoomMetaFile(path)
+		if ok {
+			metas = append(metas, meta)
+		}
+		return nil
+	})
+	return
+}
+
+func (storage *fileStorage) ReadMeta(roomname protocol.Roomname) (meta RoomMeta, ok bool, err error) {
+	meta, ok = readRoomMetaFile(roomMetaPath(storage.dir, roomname))
+	if ok && meta.Name != roomname {
+		// sha256 collision, or the file was modified
+		debug(fmt.Sprintf("storage: meta of room %s belongs to room %s", roomname, meta.Name))
+		return RoomMeta{}, false, nil
+	}
+	return
+}
+
+func readRoomMetaFile(path string) (meta RoomMeta, ok bool) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(bs, &meta); err != nil {
+		debug(fmt.Sprintf("storage: ignoring corrupted meta %s: %s", path, err))
+		return
+	}
+	return meta, true
+}
+
+func (storage *fileStorage) WriteMeta(roomname protocol.Roomname, meta RoomMeta, sync bool) error {
+	bs, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	path := roomMetaPath(storage.dir, roomname)
+	tmpPath := path + ".tmp"
+	f, err := openFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(bs)
+	if err == nil && sync {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func (storage *fileStorage) Close() error {
+	return nil
+}
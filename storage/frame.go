@@ -0,0 +1,185 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// Room files consist of frames. Each append is written as a single frame [length of data, crc32 of data, data],
+// both header fields are little endian uint32. The content of a room is the concatenation of the data of all frames.
+// An append that was interrupted by a crash leaves a torn frame at the end of the file, which is truncated on startup
+// (see fileStorage.Recover).
+const frameHeaderLen = 8
+
+var (
+	errTornFrame        = errors.New("torn frame")
+	errFrameChecksum    = errors.New("frame checksum mismatch")
+	errFrameUnreachable = errors.New("offset is not within the room content")
+)
+
+func createFrame(data []byte) []byte {
+	frame := make([]byte, frameHeaderLen+len(data))
+	binary.LittleEndian.PutUint32(frame[0:4], uint32(len(data)))
+	binary.LittleEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(data))
+	copy(frame[frameHeaderLen:], data)
+	return frame
+}
+
+// readFrameHeader returns io.EOF if r is at the end, and errTornFrame if the header is incomplete.
+func readFrameHeader(r *bufio.Reader) (length uint32, crc uint32, err error) {
+	var header [frameHeaderLen]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errTornFrame
+		}
+		return
+	}
+	return binary.LittleEndian.Uint32(header[0:4]), binary.LittleEndian.Uint32(header[4:8]), nil
+}
+
+// readFrameData reads and verifies the data of a frame.
+// The data is not allocated up front, because the length of a torn frame may be garbage.
+func readFrameData(r *bufio.Reader, length uint32, crc uint32) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if n, err := io.CopyN(buf, r, int64(length)); n < int64(length) {
+		if err == io.EOF {
+			err = errTornFrame
+		}
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(buf.Bytes()) != crc {
+		return nil, errFrameChecksum
+	}
+	return buf.Bytes(), nil
+}
+
+// skipFrameData skips the data of a frame without verifying it.
+func skipFrameData(r *bufio.Reader, length uint32) error {
+	if n, err := r.Discard(int(length)); n < int(length) {
+		if err == io.EOF {
+			err = errTornFrame
+		}
+		return err
+	}
+	return nil
+}
+
+// frameScan is the result of scanning the frames of a room file.
+type frameScan struct {
+	// size of the room content in all valid frames
+	size uint32
+	// end of the last valid frame in the file
+	end int64
+	// err is the reason why the scan stopped before the end of the file
+	err error
+	// the invalid frame extends to the end of the file, so it was torn by an interrupted append
+	torn bool
+}
+
+// scanFrames reads the frames of a room file until the first invalid frame.
+// If verify is false, the checksums are not verified, so only torn frames are detected.
+func scanFrames(f *os.File, verify bool) (scan frameScan, err error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return
+	}
+	r := bufio.NewReader(f)
+	for {
+		length, crc, err := readFrameHeader(r)
+		if err == io.EOF {
+			return scan, nil
+		}
+		if err == nil {
+			if verify {
+				_, err = readFrameData(r, length, crc)
+			} else {
+				err = skipFrameData(r, length)
+			}
+		}
+		if err == errTornFrame || err == errFrameChecksum {
+			scan.err = err
+			scan.torn = scan.end+frameHeaderLen+int64(length) >= fi.Size()
+			return scan, nil
+		}
+		if err != nil {
+			return scan, err
+		}
+		scan.size += length
+		scan.end += frameHeaderLen + int64(length)
+	}
+}
+
+// frameReader reads the room content from the frames of a room file, starting at a logical offset.
+type frameReader struct {
+	f *os.File
+	r *bufio.Reader
+	// logical bytes that still need to be skipped
+	skip uint32
+	// remaining data of the current frame
+	data []byte
+}
+
+func newFrameReader(f *os.File, offset uint32) *frameReader {
+	return &frameReader{f: f, r: bufio.NewReader(f), skip: offset}
+}
+
+func (fr *frameReader) Read(p []byte) (int, error) {
+	for len(fr.data) == 0 {
+		length, crc, err := readFrameHeader(fr.r)
+		if err != nil {
+			return 0, err
+		}
+		if length <= fr.skip {
+			// frames before offset are not verified
+			if err = skipFrameData(fr.r, length); err != nil {
+				return 0, err
+			}
+			fr.skip -= length
+			continue
+		}
+		data, err := readFrameData(fr.r, length, crc)
+		if err != nil {
+			return 0, err
+		}
+		fr.data = data[fr.skip:]
+		fr.skip = 0
+	}
+	n := copy(p, fr.data)
+	fr.data = fr.data[n:]
+	return n, nil
+}
+
+func (fr *frameReader) Close() error {
+	return fr.f.Close()
+}
+
+// findFrame returns the file position and the logical offset of the frame that contains offset.
+// If offset is the size of the room, the position is the end of the last frame.
+func findFrame(f *os.File, offset uint32) (pos int64, start uint32, err error) {
+	r := bufio.NewReader(f)
+	for {
+		length, _, err := readFrameHeader(r)
+		if err == io.EOF && start == offset {
+			return pos, start, nil
+		}
+		if err == io.EOF {
+			return 0, 0, errFrameUnreachable
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		if offset < start+length {
+			return pos, start, nil
+		}
+		if err = skipFrameData(r, length); err != nil {
+			return 0, 0, err
+		}
+		pos += frameHeaderLen + int64(length)
+		start += length
+	}
+}
@@ -0,0 +1,9 @@
+package storage
+
+import (
+	"fmt"
+)
+
+func debug(s string) {
+	fmt.Println(s)
+}
@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/jwmdev/ydb/protocol"
+)
+
+// memoryStorage keeps all rooms in memory. Content is lost when the server stops. Useful for testing.
+type memoryStorage struct {
+	mux   sync.RWMutex
+	rooms map[protocol.Roomname]*memoryRoom
+}
+
+type memoryRoom struct {
+	data []byte
+	meta *RoomMeta
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{
+		rooms: make(map[protocol.Roomname]*memoryRoom),
+	}
+}
+
+func (storage *memoryStorage) getRoom(roomname protocol.Roomname) *memoryRoom {
+	r := storage.rooms[roomname]
+	if r == nil {
+		r = &memoryRoom{}
+		storage.rooms[roomname] = r
+	}
+	return r
+}
+
+func (storage *memoryStorage) Append(roomname protocol.Roomname, data []byte) error {
+	storage.mux.Lock()
+	r := storage.getRoom(roomname)
+	r.data = append(r.data, data...)
+	storage.mux.Unlock()
+	return nil
+}
+
+func (storage *memoryStorage) ReadFrom(roomname protocol.Roomname, offset uint32) (io.ReadCloser, error) {
+	storage.mux.RLock()
+	var data []byte
+	if r := storage.rooms[roomname]; r != nil && int(offset) < len(r.data) {
+		// appends never modify existing content, so it is safe to read the slice without lock
+		data = r.data[offset:len(r.data):len(r.data)]
+	}
+	storage.mux.RUnlock()
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (storage *memoryStorage) Size(roomname protocol.Roomname) (uint32, error) {
+	storage.mux.RLock()
+	defer storage.mux.RUnlock()
+	if r := storage.rooms[roomname]; r != nil {
+		return uint32(len(r.data)), nil
+	}
+	return 0, nil
+}
+
+func (storage *memoryStorage) Replace(roomname protocol.Roomname, data []byte) error {
+	storage.mux.Lock()
+	storage.getRoom(roomname).data = append([]byte(nil), data...)
+	storage.mux.Unlock()
+	return nil
+}
+
+func (storage *memoryStorage) Truncate(roomname protocol.Roomname, size uint32) error {
+	storage.mux.Lock()
+	if r := storage.rooms[roomname]; r != nil && int(size) < len(r.data) {
+		// copy, because readers may still use the old slice
+		r.data = append([]byte(nil), r.data[:size]...)
+	}
+	storage.mux.Unlock()
+	return nil
+}
+
+// Recover does nothing, because the content does not survive a crash.
+func (storage *memoryStorage) Recover() ([]protocol.Roomname, error) {
+	return nil, nil
+}
+
+func (storage *memoryStorage) Sync(roomname protocol.Roomname) error {
+	return nil
+}
+
+func (storage *memoryStorage) Delete(roomname protocol.Roomname) error {
+	storage.mux.Lock()
+	delete(storage.rooms, roomname)
+	storage.mux.Unlock()
+	return nil
+}
+
+func (storage *memoryStorage) List() (roomnames []protocol.Roomname, err error) {
+	storage.mux.RLock()
+	for roomname, r := range storage.rooms {
+		if r.meta != nil {
+			roomnames = append(roomnames, roomname)
+		}
+	}
+	storage.mux.RUnlock()
+	return
+}
+
+func (storage *memoryStorage) ReadMeta(roomname protocol.Roomname) (meta RoomMeta, ok bool, err error) {
+	storage.mux.RLock()
+	defer storage.mux.RUnlock()
+	if r := storage.rooms[roomname]; r != nil && r.meta != nil {
+		return *r.meta, true, nil
+	}
+	return
+}
+
+func (storage *memoryStorage) WriteMeta(roomname protocol.Roomname, meta RoomMeta, sync bool) error {
+	storage.mux.Lock()
+	storage.getRoom(roomname).meta = &meta
+	storage.mux.Unlock()
+	return nil
+}
+
+func (storage *memoryStorage) Close() error {
+	return nil
+}
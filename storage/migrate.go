@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/jwmdev/ydb/protocol"
+)
+
+// Earlier versions of the file storage stored each room unframed at dir/<roomname>, and the meta of the room
+// at dir/.meta/<roomname>. Room names that contain slashes were stored in sub-directories.
+const (
+	legacyMetaDirname = ".meta"
+	// the migrated legacy files are moved here instead of being deleted
+	legacyBackupDirname = ".legacy"
+	// exists while a migration is incomplete
+	migratingFilename = ".migrating"
+)
+
+// entries of the data directory that are not legacy rooms
+var reservedNames = map[string]bool{
+	roomsDirname:           true,
+	WALDirname:             true,
+	legacyMetaDirname:      true,
+	legacyBackupDirname:    true,
+	migratingFilename:      true,
+	IndexFilename:          true,
+	IndexFilename + ".tmp": true,
+	boltFilename:           true,
+	"lost+found":           true,
+}
+
+// findLegacyRooms returns the legacy rooms in dir, and the top-level entries of dir that contain them.
+// Rooms are only migrated once: if the current layout exists and no migration is incomplete, there are none.
+func findLegacyRooms(dir string) (roomnames []protocol.Roomname, entries []string, err error) {
+	_, err = os.Stat(filepath.Join(dir, migratingFilename))
+	migrating := err == nil
+	if _, err = os.Stat(filepath.Join(dir, roomsDirname)); err == nil && !migrating {
+		return nil, nil, nil
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, info := range infos {
+		if reservedNames[info.Name()] {
+			continue
+		}
+		n := len(roomnames)
+		err = filepath.Walk(filepath.Join(dir, info.Name()), func(path string, info os.FileInfo, err error) error {
+			if err != nil || !info.Mode().IsRegular() {
+				return err
+			}
+			rel, err := filepath.Rel(dir, path)
+			roomnames = append(roomnames, protocol.Roomname(filepath.ToSlash(rel)))
+			return err
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(roomnames) > n {
+			entries = append(entries, info.Name())
+		}
+	}
+	return
+}
+
+// migrateLegacyRooms copies legacy rooms to the current layout (see roomFilePath and frame.go), and then moves the
+// legacy files to dir/.legacy. dir/.migrating marks an incomplete migration, so an interrupted migration continues
+// on the next start. Rooms without a clean legacy meta get a new roomsessionid when the room index is loaded,
+// so clients resync.
+func migrateLegacyRooms(storage *fileStorage) error {
+	roomnames, entries, err := findLegacyRooms(storage.dir)
+	if err != nil {
+		return err
+	}
+	marker := filepath.Join(storage.dir, migratingFilename)
+	_, err = os.Stat(marker)
+	migrating := err == nil
+	if len(roomnames) == 0 && !migrating {
+		return nil
+	}
+	if !migrating {
+		if err := ioutil.WriteFile(marker, nil, stdPerms); err != nil {
+			return err
+		}
+		if err := SyncDir(storage.dir); err != nil {
+			return err
+		}
+	}
+	for _, roomname := range roomnames {
+		if err := migrateLegacyRoom(storage, roomname); err != nil {
+			return fmt.Errorf("room %s: %s", roomname, err)
+		}
+	}
+	backup := filepath.Join(storage.dir, legacyBackupDirname)
+	if err := os.MkdirAll(backup, dirPerms); err != nil {
+		return err
+	}
+	// the legacy meta is moved last, so that rooms that are migrated again keep it
+	if _, err := os.Stat(filepath.Join(storage.dir, legacyMetaDirname)); err == nil {
+		entries = append(entries, legacyMetaDirname)
+	}
+	for _, entry := range entries {
+		if err := os.Rename(filepath.Join(storage.dir, entry), filepath.Join(backup, entry)); err != nil {
+			return err
+		}
+	}
+	if err := SyncDir(backup); err != nil {
+		return err
+	}
+	if err := os.Remove(marker); err != nil {
+		return err
+	}
+	fmt.Printf("ydb: migrated %d rooms to the current storage layout, the legacy files were moved to %s\n", len(roomnames), backup)
+	return SyncDir(storage.dir)
+}
+
+func migrateLegacyRoom(storage *fileStorage, roomname protocol.Roomname) error {
+	rel := filepath.FromSlash(string(roomname))
+	path := filepath.Join(storage.dir, rel)
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	meta := RoomMeta{Created: info.ModTime(), Modified: info.ModTime()}
+	if bs, err := ioutil.ReadFile(filepath.Join(storage.dir, legacyMetaDirname, rel)); err == nil {
+		if err := json.Unmarshal(bs, &meta); err != nil {
+			meta.Clean = false
+		}
+	}
+	meta.Name = roomname
+	if meta.Offset != uint32(len(data)) {
+		// the legacy meta is missing or outdated
+		meta.Offset = uint32(len(data))
+		meta.Clean = false
+	}
+	if err := storage.Replace(roomname, data); err != nil {
+		return err
+	}
+	if err := storage.WriteMeta(roomname, meta, true); err != nil {
+		return err
+	}
+	return SyncDir(filepath.Dir(roomMetaPath(storage.dir, roomname)))
+}
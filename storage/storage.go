@@ -0,0 +1,90 @@
+// Package storage implements the backends that persist the content and the meta of rooms.
+package storage
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"time"
+
+	"github.com/jwmdev/ydb/protocol"
+)
+
+// Storage persists the content and the meta of rooms.
+// Implementations must be safe for parallel access. The fswriter makes sure that a room is only modified by one
+// goroutine at a time.
+type Storage interface {
+	// Append data to the content of a room. Creates the room if it does not exist.
+	Append(roomname protocol.Roomname, data []byte) error
+	// ReadFrom reads the content of a room, starting at offset. Reading a room that does not exist yields no data.
+	ReadFrom(roomname protocol.Roomname, offset uint32) (io.ReadCloser, error)
+	// Size of the content of a room. Zero if the room does not exist.
+	Size(roomname protocol.Roomname) (uint32, error)
+	// Replace atomically replaces the content of a room. The meta is not changed.
+	Replace(roomname protocol.Roomname, data []byte) error
+	// Truncate the content of a room to size. The meta is not changed.
+	Truncate(roomname protocol.Roomname, size uint32) error
+	// Recover repairs the content of rooms after a crash, and returns the rooms that could not be repaired.
+	Recover() (corrupted []protocol.Roomname, err error)
+	// Sync makes sure that all appended data of a room is durable.
+	Sync(roomname protocol.Roomname) error
+	// Delete the content and the meta of a room.
+	Delete(roomname protocol.Roomname) error
+	// List the names of all rooms that have a meta.
+	List() ([]protocol.Roomname, error)
+	// ReadMeta returns ok=false if the room has no meta.
+	ReadMeta(roomname protocol.Roomname) (meta RoomMeta, ok bool, err error)
+	// WriteMeta atomically replaces the meta of a room. If sync is true, the meta must be durable when WriteMeta returns.
+	WriteMeta(roomname protocol.Roomname, meta RoomMeta, sync bool) error
+	Close() error
+}
+
+// RoomMeta is persisted with the room content. It allows Ydb to keep the roomsessionid of a room across restarts.
+// It also serves as the reverse index from stored rooms to room names (see Storage.List).
+type RoomMeta struct {
+	Name protocol.Roomname `json:"name"`
+	Rsid uint32            `json:"rsid"`
+	// offset that was persisted when the meta was written
+	Offset   uint32    `json:"offset"`
+	Created  time.Time `json:"created"`
+	Modified time.Time `json:"modified"`
+	// Clean is true if the storage contains all data that was ever sent to clients.
+	// It is set to false while the room is modified and set to true when Ydb is closed.
+	Clean bool `json:"clean"`
+	// Tiered is true if the content was moved to the blob store (see tiering in package server)
+	Tiered bool `json:"tiered,omitempty"`
+}
+
+// storage backends that can be selected with `ydb start --storage`
+const (
+	KindFile   = "file"
+	KindMemory = "memory"
+	KindBolt   = "bolt"
+)
+
+const boltFilename = "ydb.bolt"
+
+// IndexFilename is the name of the room index that package server saves in the data directory.
+const IndexFilename = "rooms.index"
+
+// Open opens the storage backend kind in dir.
+func Open(kind string, dir string) (Storage, error) {
+	switch kind {
+	case KindFile:
+		return newFileStorage(dir)
+	case KindMemory:
+		return newMemoryStorage(), nil
+	case KindBolt:
+		return newBoltStorage(filepath.Join(dir, boltFilename))
+	}
+	return nil, fmt.Errorf("unknown storage \"%s\" (expected file, memory, or bolt)", kind)
+}
+
+// OpenExisting opens a storage like Open, but does not migrate rooms of earlier versions, so that it does not modify
+// a data directory that a running server may use (e.g. ydb ls). Fails if the rooms must be migrated first.
+func OpenExisting(kind string, dir string) (Storage, error) {
+	if kind == KindFile {
+		return openExistingFileStorage(dir)
+	}
+	return Open(kind, dir)
+}
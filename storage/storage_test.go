@@ -0,0 +1,289 @@
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/jwmdev/ydb/protocol"
+)
+
+// TestStorage runs the same tests against all storage backends.
+func TestStorage(t *testing.T) {
+	for _, kind := range []string{KindFile, KindMemory, KindBolt} {
+		t.Run(kind, func(t *testing.T) {
+			dir := "_test_storage_" + kind
+			os.RemoveAll(dir)
+			os.MkdirAll(dir, dirPerms)
+			defer os.RemoveAll(dir)
+			storage, err := Open(kind, dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer storage.Close()
+			testStorage(t, storage)
+		})
+	}
+}
+
+func testStorage(t *testing.T, storage Storage) {
+	if size, err := storage.Size("a"); size != 0 || err != nil {
+		t.Errorf("expected empty room, got size %d (error: %v)", size, err)
+	}
+	storage.Append("a", []byte{1, 2, 3})
+	storage.Append("a", []byte{4, 5})
+	storage.Append("b", []byte{6})
+	if size, _ := storage.Size("a"); size != 5 {
+		t.Errorf("expected size 5, got %d", size)
+	}
+	for offset := uint32(0); offset <= 6; offset++ {
+		expected := []byte{1, 2, 3, 4, 5}
+		if int(offset) < len(expected) {
+			expected = expected[offset:]
+		} else {
+			expected = nil
+		}
+		r, err := storage.ReadFrom("a", offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(r)
+		r.Close()
+		if !bytes.Equal(data, expected) {
+			t.Errorf("ReadFrom(%d): expected %v, got %v", offset, expected, data)
+		}
+	}
+	if err := storage.Truncate("b", 0); err != nil {
+		t.Fatal(err)
+	}
+	storage.Append("c", []byte{1, 2})
+	storage.Append("c", []byte{3, 4})
+	storage.Truncate("c", 3)
+	r, _ := storage.ReadFrom("c", 0)
+	if data, _ := ioutil.ReadAll(r); !bytes.Equal(data, []byte{1, 2, 3}) {
+		t.Errorf("expected truncated room to contain [1 2 3], got %v", data)
+	}
+	r.Close()
+	if size, _ := storage.Size("b"); size != 0 {
+		t.Errorf("expected truncated room to be empty, got size %d", size)
+	}
+	storage.Replace("c", []byte{7, 8})
+	r, _ = storage.ReadFrom("c", 0)
+	if data, _ := ioutil.ReadAll(r); !bytes.Equal(data, []byte{7, 8}) {
+		t.Errorf("expected replaced room to contain [7 8], got %v", data)
+	}
+	r.Close()
+	if _, ok, _ := storage.ReadMeta("a"); ok {
+		t.Error("expected no meta")
+	}
+	if err := storage.WriteMeta("a", RoomMeta{Name: "a", Rsid: 42, Offset: 5}, true); err != nil {
+		t.Fatal(err)
+	}
+	if meta, ok, _ := storage.ReadMeta("a"); !ok || meta.Rsid != 42 || meta.Offset != 5 {
+		t.Errorf("unexpected meta %v", meta)
+	}
+	if roomnames, _ := storage.List(); len(roomnames) != 1 || roomnames[0] != "a" {
+		t.Errorf("expected to list room a, got %v", roomnames)
+	}
+	if err := storage.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if size, _ := storage.Size("a"); size != 0 {
+		t.Errorf("expected deleted room to be empty, got size %d", size)
+	}
+	if roomnames, _ := storage.List(); len(roomnames) != 0 {
+		t.Errorf("expected no rooms, got %v", roomnames)
+	}
+}
+
+// TestRoomFilePath tests that room names can't escape the data directory and can be listed again.
+func TestRoomFilePath(t *testing.T) {
+	dir := "_test_roompath"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	storage, err := newFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roomnames := []protocol.Roomname{"../escape", "a/b", "/", "", protocol.Roomname(strings.Repeat("x", 1000))}
+	for i, roomname := range roomnames {
+		path := roomFilePath(dir, roomname)
+		if !strings.HasPrefix(path, filepath.Join(dir, roomsDirname)+string(filepath.Separator)) || filepath.Clean(path) != path {
+			t.Errorf("room %q is mapped outside of the rooms directory: %s", roomname, path)
+		}
+		storage.Append(roomname, []byte{byte(i)})
+		storage.WriteMeta(roomname, RoomMeta{Name: roomname}, false)
+	}
+	listed, err := storage.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(roomnames, func(i, j int) bool { return roomnames[i] < roomnames[j] })
+	sort.Slice(listed, func(i, j int) bool { return listed[i] < listed[j] })
+	if len(listed) != len(roomnames) {
+		t.Fatalf("expected %d rooms, got %d", len(roomnames), len(listed))
+	}
+	for i := range listed {
+		if listed[i] != roomnames[i] {
+			t.Errorf("expected room %q, got %q", roomnames[i], listed[i])
+		}
+	}
+}
+
+// TestFileStorageRecover tests that torn appends are truncated, and that corrupted rooms are reported.
+// Rooms that were closed cleanly are not scanned.
+func TestFileStorageRecover(t *testing.T) {
+	dir := "_test_storage_recover"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	storage, err := newFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, roomname := range []protocol.Roomname{"torn", "corrupted", "clean"} {
+		storage.WriteMeta(roomname, RoomMeta{Name: roomname, Clean: roomname == "clean"}, false)
+		storage.Append(roomname, []byte{1, 2, 3})
+		storage.Append(roomname, []byte{4, 5})
+	}
+	f, _ := os.OpenFile(roomFilePath(dir, "clean"), os.O_WRONLY, stdPerms)
+	f.WriteAt([]byte{9}, frameHeaderLen)
+	f.Close()
+	// an append that was interrupted after writing part of the frame
+	f, _ = os.OpenFile(roomFilePath(dir, "torn"), os.O_APPEND|os.O_WRONLY, stdPerms)
+	f.Write(createFrame([]byte{6, 7, 8})[:frameHeaderLen+1])
+	f.Close()
+	// flip a byte of the first frame
+	f, _ = os.OpenFile(roomFilePath(dir, "corrupted"), os.O_WRONLY, stdPerms)
+	f.WriteAt([]byte{9}, frameHeaderLen)
+	f.Close()
+
+	corrupted, err := storage.Recover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(corrupted) != 1 || corrupted[0] != "corrupted" {
+		t.Errorf("expected only room corrupted to be reported, got %v", corrupted)
+	}
+	r, _ := storage.ReadFrom("torn", 0)
+	if data, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(data, []byte{1, 2, 3, 4, 5}) {
+		t.Errorf("expected recovered room to contain [1 2 3 4 5], got %v (error: %v)", data, err)
+	}
+	r.Close()
+	if fi, _ := os.Stat(roomFilePath(dir, "torn")); fi.Size() != 2*frameHeaderLen+5 {
+		t.Errorf("expected torn frame to be truncated, file has %d bytes", fi.Size())
+	}
+	r, _ = storage.ReadFrom("corrupted", 0)
+	if _, err := ioutil.ReadAll(r); err != errFrameChecksum {
+		t.Errorf("expected reading a corrupted room to fail with a checksum error, got %v", err)
+	}
+	r.Close()
+}
+
+// TestMigrateLegacyRooms tests that rooms of earlier versions are moved to the current layout once, when the file
+// storage is opened, and that the legacy files are kept.
+func TestMigrateLegacyRooms(t *testing.T) {
+	dir := "_test_migrate"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "docs"), dirPerms)
+	os.MkdirAll(filepath.Join(dir, legacyMetaDirname), dirPerms)
+	os.MkdirAll(filepath.Join(dir, "empty"), dirPerms)
+	ioutil.WriteFile(filepath.Join(dir, "a"), []byte{1, 2, 3}, stdPerms)
+	ioutil.WriteFile(filepath.Join(dir, legacyMetaDirname, "a"), []byte(`{"rsid":7,"offset":3,"clean":true}`), stdPerms)
+	ioutil.WriteFile(filepath.Join(dir, "docs", "b"), []byte{4}, stdPerms)
+	ioutil.WriteFile(filepath.Join(dir, IndexFilename), []byte("{}"), stdPerms)
+	if _, err := OpenExisting(KindFile, dir); err == nil {
+		t.Error("expected OpenExisting to refuse rooms that must be migrated")
+	}
+	if _, err := os.Stat(filepath.Join(dir, roomsDirname)); !os.IsNotExist(err) {
+		t.Error("expected OpenExisting not to modify the directory")
+	}
+	for i := 0; i < 2; i++ {
+		storage, err := newFileStorage(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for roomname, expected := range map[protocol.Roomname]RoomMeta{
+			"a":      {Name: "a", Rsid: 7, Offset: 3, Clean: true},
+			"docs/b": {Name: "docs/b", Offset: 1},
+		} {
+			meta, ok, _ := storage.ReadMeta(roomname)
+			if !ok || meta.Rsid != expected.Rsid || meta.Offset != expected.Offset || meta.Clean != expected.Clean {
+				t.Errorf("room %s: expected meta %+v, got %+v", roomname, expected, meta)
+			}
+			if size, _ := storage.Size(roomname); size != expected.Offset {
+				t.Errorf("room %s: expected %d bytes, got %d", roomname, expected.Offset, size)
+			}
+		}
+		// files that are added after the migration are not rooms (e.g. a blob store)
+		os.MkdirAll(filepath.Join(dir, "blobs"), dirPerms)
+		ioutil.WriteFile(filepath.Join(dir, "blobs", "c"), []byte{5}, stdPerms)
+	}
+	for _, name := range []string{"a", "docs", legacyMetaDirname, migratingFilename} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed from the data directory", name)
+		}
+	}
+	for _, name := range []string{"a", "docs/b", legacyMetaDirname + "/a"} {
+		if _, err := os.Stat(filepath.Join(dir, legacyBackupDirname, filepath.FromSlash(name))); err != nil {
+			t.Errorf("expected legacy file %s to be kept: %s", name, err)
+		}
+	}
+	for _, name := range []string{IndexFilename, "empty", "blobs/c"} {
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name))); err != nil {
+			t.Errorf("expected %s to be kept: %s", name, err)
+		}
+	}
+	if storage, err := OpenExisting(KindFile, dir); err != nil {
+		t.Error(err)
+	} else if roomnames, _ := storage.List(); len(roomnames) != 2 {
+		t.Errorf("expected 2 rooms, got %v", roomnames)
+	}
+}
+
+// TestMigrateLegacyRoomsResumes tests that an interrupted migration continues on the next start.
+func TestMigrateLegacyRoomsResumes(t *testing.T) {
+	dir := "_test_migrate_resumes"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, roomsDirname), dirPerms)
+	ioutil.WriteFile(filepath.Join(dir, migratingFilename), nil, stdPerms)
+	ioutil.WriteFile(filepath.Join(dir, "a"), []byte{1, 2, 3}, stdPerms)
+	storage, err := newFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size, _ := storage.Size("a"); size != 3 {
+		t.Errorf("expected room a to be migrated, got %d bytes", size)
+	}
+	if _, err := os.Stat(filepath.Join(dir, migratingFilename)); !os.IsNotExist(err) {
+		t.Error("expected the migration to be completed")
+	}
+}
+
+// TestDirBlobStore tests that blobs are streamed to the blob store, and that short blobs are rejected.
+func TestDirBlobStore(t *testing.T) {
+	dir := "_test_blobs"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	store, err := NewDirBlobStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put("rooms/a", bytes.NewReader([]byte{1, 2, 3}), 3); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := store.Get("rooms/a"); err != nil || !bytes.Equal(data, []byte{1, 2, 3}) {
+		t.Errorf("expected blob [1 2 3], got %v (error: %v)", data, err)
+	}
+	if err := store.Put("rooms/b", bytes.NewReader([]byte{1, 2}), 3); err == nil {
+		t.Error("expected a short blob to be rejected")
+	}
+	if _, err := store.Get("rooms/b"); !os.IsNotExist(err) {
+		t.Errorf("expected no partial blob, got error %v", err)
+	}
+}
@@ -0,0 +1,412 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jwmdev/ydb/protocol"
+)
+
+const (
+	WALDirname = ".wal"
+	// a new segment is started when the current segment exceeds this size
+	walMaxSegmentSize = 64 * 1024 * 1024
+	// maximum number of room appends that are committed with a single fsync
+	walMaxBatchLen = 1000
+)
+
+// walCheckpointInterval is how often a segment that is not empty is replaced by a new segment and checkpointed,
+// so that a server with little traffic does not replay the same segment on every start. A variable for tests.
+var walCheckpointInterval = time.Minute
+
+// WAL is a write-ahead log for room appends.
+// Appends from all write tasks are batched into the current segment and committed with a single fsync (group commit).
+// Only after the commit, the data is written to the storage. A segment is removed after all of its
+// appends were written to the storage and the rooms were synced (checkpoint).
+// On startup, the remaining segments are replayed to rebuild the rooms. A corrupted record in the middle of a segment
+// fails the replay, because committed appends would be lost.
+type WAL struct {
+	dir           string
+	storage       Storage
+	entries       chan *walEntry
+	segment       *WALSegment
+	nextSegmentID uint64
+	// set if a torn batch could neither be removed nor left behind in an old segment. All commits fail afterwards,
+	// because replay stops at the torn batch. Only accessed by the commit task
+	failed error
+	// closed when the commit task ends
+	stopped chan struct{}
+}
+
+type walEntry struct {
+	roomname protocol.Roomname
+	// roomsessionid of the room when data was appended
+	rsid uint32
+	// offset in the room where data is appended
+	offset  uint32
+	data    []byte
+	segment *WALSegment
+	done    chan error
+}
+
+type WALSegment struct {
+	id   uint64
+	f    *os.File
+	size int64
+	// number of committed appends that are not yet written to the storage
+	unapplied sync.WaitGroup
+	// rooms that have appends in this segment
+	rooms map[protocol.Roomname]struct{}
+}
+
+func walSegmentPath(dir string, id uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%016x.wal", id))
+}
+
+// NewWAL replays existing segments in dir to the storage and starts the commit task.
+func NewWAL(dir string, storage Storage) (*WAL, error) {
+	if err := os.MkdirAll(dir, dirPerms); err != nil {
+		return nil, err
+	}
+	wal := &WAL{
+		dir:     dir,
+		storage: storage,
+		entries: make(chan *walEntry, walMaxBatchLen),
+		stopped: make(chan struct{}),
+	}
+	if err := wal.replay(); err != nil {
+		return nil, err
+	}
+	if err := wal.startSegment(); err != nil {
+		return nil, err
+	}
+	go wal.startCommitTask(walCheckpointInterval)
+	return wal, nil
+}
+
+// Commit appends data to the log and returns after the append was fsynced.
+// The caller must call segment.applied() after data was written to the storage.
+func (wal *WAL) Commit(roomname protocol.Roomname, rsid uint32, offset uint32, data []byte) (*WALSegment, error) {
+	entry := &walEntry{
+		roomname: roomname,
+		rsid:     rsid,
+		offset:   offset,
+		data:     data,
+		done:     make(chan error, 1),
+	}
+	wal.entries <- entry
+	err := <-entry.done
+	return entry.segment, err
+}
+
+// Close stops the commit task and closes the current segment. Commit must not be called afterwards.
+// The segments are replayed when the wal is opened again.
+func (wal *WAL) Close() error {
+	close(wal.entries)
+	<-wal.stopped
+	return wal.segment.f.Close()
+}
+
+// Applied marks that a committed append was written to the storage.
+func (segment *WALSegment) Applied() {
+	segment.unapplied.Done()
+}
+
+func (wal *WAL) startCommitTask(checkpointInterval time.Duration) {
+	ticker := time.NewTicker(checkpointInterval)
+	defer ticker.Stop()
+	defer close(wal.stopped)
+	for {
+		var entry *walEntry
+		var ok bool
+		select {
+		case entry, ok = <-wal.entries:
+			if !ok {
+				return
+			}
+		case <-ticker.C:
+			if wal.segment.size > 0 {
+				wal.rotate()
+			}
+			continue
+		}
+		batch := []*walEntry{entry}
+	collect:
+		for len(batch) < walMaxBatchLen {
+			select {
+			case entry := <-wal.entries:
+				batch = append(batch, entry)
+			default:
+				break collect
+			}
+		}
+		err := wal.writeBatch(batch)
+		for _, entry := range batch {
+			entry.done <- err
+		}
+		if err == nil && wal.segment.size >= walMaxSegmentSize {
+			// if this fails, a new segment is started after the next batch
+			wal.rotate()
+		}
+	}
+}
+
+// rotate starts a new segment and checkpoints the current segment. Keeps appending to the current segment if
+// no segment can be started.
+func (wal *WAL) rotate() error {
+	old := wal.segment
+	if err := wal.startSegment(); err != nil {
+		fmt.Printf("ydb error: unable to start wal segment: %s\n", err)
+		return err
+	}
+	go wal.checkpoint(old)
+	return nil
+}
+
+func (wal *WAL) writeBatch(batch []*walEntry) error {
+	if wal.failed != nil {
+		return wal.failed
+	}
+	segment := wal.segment
+	buf := &bytes.Buffer{}
+	for _, entry := range batch {
+		writeWALRecord(buf, entry.roomname, entry.rsid, entry.offset, entry.data)
+	}
+	size := segment.size
+	n, err := segment.f.Write(buf.Bytes())
+	segment.size += int64(n)
+	if err == nil {
+		err = segment.f.Sync()
+	}
+	if err != nil {
+		// remove the torn batch, because replay stops at the first torn record. If that fails, the torn batch
+		// must stay the last record of its segment
+		if terr := segment.f.Truncate(size); terr == nil {
+			segment.size = size
+		} else if rerr := wal.rotate(); rerr != nil {
+			wal.failed = fmt.Errorf("wal failed: unable to remove a torn batch (%s) or to start a new segment (%s)", terr, rerr)
+		}
+		return err
+	}
+	segment.unapplied.Add(len(batch))
+	for _, entry := range batch {
+		entry.segment = segment
+		segment.rooms[entry.roomname] = struct{}{}
+	}
+	return nil
+}
+
+func (wal *WAL) startSegment() error {
+	id := wal.nextSegmentID
+	f, err := os.OpenFile(walSegmentPath(wal.dir, id), os.O_APPEND|os.O_WRONLY|os.O_CREATE|os.O_EXCL, stdPerms)
+	if err != nil {
+		return err
+	}
+	wal.nextSegmentID++
+	wal.segment = &WALSegment{
+		id:    id,
+		f:     f,
+		rooms: make(map[protocol.Roomname]struct{}),
+	}
+	return nil
+}
+
+// checkpoint removes a segment after all of its appends are durable in the storage.
+// If that fails, the segment is kept and replayed on the next start.
+func (wal *WAL) checkpoint(segment *WALSegment) {
+	segment.unapplied.Wait()
+	segment.f.Close()
+	for roomname := range segment.rooms {
+		if err := wal.storage.Sync(roomname); err != nil {
+			fmt.Printf("ydb error: unable to checkpoint wal segment %d: %s\n", segment.id, err)
+			return
+		}
+	}
+	if err := os.Remove(walSegmentPath(wal.dir, segment.id)); err != nil {
+		fmt.Printf("ydb error: unable to remove wal segment %d: %s\n", segment.id, err)
+	}
+}
+
+// replay applies all existing segments to the storage, syncs the rooms, and removes the segments.
+func (wal *WAL) replay() error {
+	d, err := os.Open(wal.dir)
+	if err != nil {
+		return err
+	}
+	names, err := d.Readdirnames(-1)
+	d.Close()
+	if err != nil {
+		return err
+	}
+	var ids []uint64
+	for _, name := range names {
+		var id uint64
+		if !strings.HasSuffix(name, ".wal") {
+			continue
+		}
+		if _, err := fmt.Sscanf(name, "%016x.wal", &id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	rooms := make(map[protocol.Roomname]*walReplayRoom)
+	for _, id := range ids {
+		if err := wal.replaySegment(walSegmentPath(wal.dir, id), rooms); err != nil {
+			return err
+		}
+		wal.nextSegmentID = id + 1
+	}
+	for roomname, room := range rooms {
+		if !room.appended {
+			continue
+		}
+		if err := wal.storage.Sync(roomname); err != nil {
+			return err
+		}
+	}
+	for _, id := range ids {
+		if err := os.Remove(walSegmentPath(wal.dir, id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (wal *WAL) replaySegment(path string, rooms map[protocol.Roomname]*walReplayRoom) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for {
+		roomname, rsid, offset, data, err := readWALRecord(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if _, perr := r.Peek(1); perr == io.EOF {
+				// a torn record at the end of the segment was never committed
+				debug(fmt.Sprintf("wal: stopped replaying %s: %s", path, err))
+				return nil
+			}
+			// the records after the corrupted record were committed, but they can't be found
+			return fmt.Errorf("wal segment %s is corrupted: %s", path, err)
+		}
+		room, ok := rooms[roomname]
+		if !ok {
+			if room, err = readWALReplayRoom(wal.storage, roomname); err != nil {
+				return err
+			}
+			rooms[roomname] = room
+		}
+		if err := room.replayAppend(wal.storage, roomname, rsid, offset, data); err != nil {
+			return err
+		}
+	}
+}
+
+// walReplayRoom is the state of a room during replay. The meta and the size of each room are read once, because
+// reading them may be expensive (e.g. fileStorage.Size scans the room).
+type walReplayRoom struct {
+	meta    RoomMeta
+	hasMeta bool
+	size    uint32
+	// whether any append was applied, so that the room must be synced
+	appended bool
+}
+
+func readWALReplayRoom(storage Storage, roomname protocol.Roomname) (*walReplayRoom, error) {
+	meta, ok, err := storage.ReadMeta(roomname)
+	if err != nil {
+		return nil, err
+	}
+	size, err := storage.Size(roomname)
+	if err != nil {
+		return nil, err
+	}
+	return &walReplayRoom{meta: meta, hasMeta: ok, size: size}, nil
+}
+
+// replayAppend appends data at offset to the room, unless the storage already contains it.
+// Appends are skipped if the content of the room was replaced since (e.g. by compaction).
+func (room *walReplayRoom) replayAppend(storage Storage, roomname protocol.Roomname, rsid uint32, offset uint32, data []byte) error {
+	if room.hasMeta && room.meta.Rsid != rsid {
+		return nil
+	}
+	end := offset + uint32(len(data))
+	if room.size >= end {
+		return nil
+	}
+	if room.size < offset {
+		debug(fmt.Sprintf("wal: room %s ends at %d, but append starts at %d", roomname, room.size, offset))
+		return nil
+	}
+	if err := storage.Append(roomname, data[room.size-offset:]); err != nil {
+		return err
+	}
+	room.size = end
+	room.appended = true
+	return nil
+}
+
+// a wal record is structured as [crc32 of body, length of body, body], where body is [roomname, rsid, offset, data]
+func writeWALRecord(buf *bytes.Buffer, roomname protocol.Roomname, rsid uint32, offset uint32, data []byte) {
+	body := &bytes.Buffer{}
+	protocol.WriteRoomname(body, roomname)
+	protocol.WriteUvarint(body, uint64(rsid))
+	protocol.WriteUvarint(body, uint64(offset))
+	protocol.WritePayload(body, data)
+	var crc [4]byte
+	binary.LittleEndian.PutUint32(crc[:], crc32.ChecksumIEEE(body.Bytes()))
+	buf.Write(crc[:])
+	protocol.WritePayload(buf, body.Bytes())
+}
+
+func readWALRecord(r *bufio.Reader) (roomname protocol.Roomname, rsid uint32, offset uint32, data []byte, err error) {
+	var crc [4]byte
+	if _, err = io.ReadFull(r, crc[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = fmt.Errorf("truncated record header")
+		}
+		return
+	}
+	bodyLen, err := binary.ReadUvarint(r)
+	if err != nil {
+		err = fmt.Errorf("truncated record length")
+		return
+	}
+	if bodyLen > walMaxSegmentSize+protocol.MaxMessageSize {
+		err = fmt.Errorf("invalid record length %d", bodyLen)
+		return
+	}
+	body := make([]byte, bodyLen)
+	if _, err = io.ReadFull(r, body); err != nil {
+		err = fmt.Errorf("truncated record body")
+		return
+	}
+	if binary.LittleEndian.Uint32(crc[:]) != crc32.ChecksumIEEE(body) {
+		err = fmt.Errorf("record checksum mismatch")
+		return
+	}
+	buf := bytes.NewBuffer(body)
+	// records may predate protocol.MaxRoomnameLength
+	name, _ := protocol.ReadString(buf)
+	roomname = protocol.Roomname(name)
+	r32, _ := binary.ReadUvarint(buf)
+	rsid = uint32(r32)
+	off, _ := binary.ReadUvarint(buf)
+	offset = uint32(off)
+	data, _ = protocol.ReadPayload(buf)
+	return
+}
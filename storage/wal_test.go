@@ -0,0 +1,182 @@
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jwmdev/ydb/protocol"
+)
+
+// TestWALReplay tests that committed appends are written to the room files when the wal is opened again.
+func TestWALReplay(t *testing.T) {
+	dir := "_test_wal"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	walDir := filepath.Join(dir, WALDirname)
+	storage, _ := newFileStorage(dir)
+	w, err := NewWAL(walDir, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Commit("a", 1, 0, []byte{1, 2, 3})
+	w.Commit("b", 1, 0, []byte{4})
+	w.Commit("a", 1, 3, []byte{5, 6})
+	// the content of "c" was replaced after the append was committed
+	w.Commit("c", 1, 0, []byte{1})
+	w.Close()
+	storage.WriteMeta("c", RoomMeta{Name: "c", Rsid: 2}, true)
+	// simulate a crash after the second append of "a" was partially written to the room file
+	storage.WriteMeta("a", RoomMeta{Name: "a", Rsid: 1}, true)
+	storage.Append("a", []byte{1, 2, 3})
+	f, _ := os.OpenFile(roomFilePath(dir, "a"), os.O_APPEND|os.O_WRONLY, stdPerms)
+	f.Write(createFrame([]byte{5, 6})[:frameHeaderLen+1])
+	f.Close()
+	// simulate a torn record at the end of the segment
+	f, _ = os.OpenFile(walSegmentPath(walDir, w.segment.id), os.O_APPEND|os.O_WRONLY, stdPerms)
+	buf := &bytes.Buffer{}
+	writeWALRecord(buf, "b", 1, 1, []byte{7, 8, 9})
+	f.Write(buf.Bytes()[:buf.Len()-2])
+	f.Close()
+
+	if _, err := storage.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	replayed, err := NewWAL(walDir, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replayed.Close()
+	expected := map[protocol.Roomname][]byte{
+		"a": {1, 2, 3, 5, 6},
+		"b": {4},
+		"c": {},
+	}
+	for roomname, data := range expected {
+		r, err := storage.ReadFrom(roomname, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(content, data) {
+			t.Errorf("room %s: expected %v, got %v", roomname, data, content)
+		}
+	}
+	if _, err := os.Stat(walSegmentPath(walDir, w.segment.id)); !os.IsNotExist(err) {
+		t.Error("expected replayed segment to be removed")
+	}
+}
+
+// TestWALCorruption tests that a corrupted record in the middle of a segment fails the replay.
+func TestWALCorruption(t *testing.T) {
+	dir := "_test_wal_corruption"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	walDir := filepath.Join(dir, WALDirname)
+	storage, _ := newFileStorage(dir)
+	os.MkdirAll(walDir, dirPerms)
+	buf := &bytes.Buffer{}
+	writeWALRecord(buf, "a", 1, 0, []byte{1, 2, 3})
+	writeWALRecord(buf, "a", 1, 3, []byte{4})
+	segment := buf.Bytes()
+	// flip a byte of the data of the first record
+	segment[len(segment)/2-3] ^= 0xff
+	ioutil.WriteFile(walSegmentPath(walDir, 0), segment, stdPerms)
+	if _, err := NewWAL(walDir, storage); err == nil {
+		t.Error("expected the corrupted segment to fail the replay")
+	}
+}
+
+// TestWALRotation tests that the wal continues in a new segment if a torn batch can't be removed,
+// and that segments are checkpointed on an idle server.
+func TestWALRotation(t *testing.T) {
+	dir := "_test_wal_rotation"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	defer func(interval time.Duration) { walCheckpointInterval = interval }(walCheckpointInterval)
+	walCheckpointInterval = 50 * time.Millisecond
+	walDir := filepath.Join(dir, WALDirname)
+	storage, _ := newFileStorage(dir)
+	w, err := NewWAL(walDir, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	first := w.segment
+	// writes and truncation of the closed segment fail
+	first.f.Close()
+	if _, err := w.Commit("a", 1, 0, []byte{1}); err == nil {
+		t.Fatal("expected the commit to fail")
+	}
+	segment, err := w.Commit("a", 1, 0, []byte{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if segment == first {
+		t.Error("expected the wal to continue in a new segment")
+	}
+	storage.Append("a", []byte{1})
+	segment.Applied()
+	deadline := time.Now().Add(10 * time.Second)
+	for _, id := range []uint64{first.id, segment.id} {
+		for {
+			if _, err := os.Stat(walSegmentPath(walDir, id)); os.IsNotExist(err) {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected segment %d to be checkpointed", id)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+// sizeCountingStorage counts the calls of Size.
+type sizeCountingStorage struct {
+	Storage
+	sizes int
+}
+
+func (storage *sizeCountingStorage) Size(roomname protocol.Roomname) (uint32, error) {
+	storage.sizes++
+	return storage.Storage.Size(roomname)
+}
+
+// TestWALReplayReadsRoomsOnce tests that the size of each room is read once per replay, not once per record.
+func TestWALReplayReadsRoomsOnce(t *testing.T) {
+	dir := "_test_wal_replay_once"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+	walDir := filepath.Join(dir, WALDirname)
+	store, _ := newFileStorage(dir)
+	storage := &sizeCountingStorage{Storage: store}
+	w, err := NewWAL(walDir, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		w.Commit("a", 1, uint32(i), []byte{byte(i)})
+	}
+	// the appends were never applied, so the segment is replayed
+	w.Close()
+
+	storage.sizes = 0
+	replayed, err := NewWAL(walDir, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replayed.Close()
+	if storage.sizes != 1 {
+		t.Errorf("expected the size to be read once, got %d reads", storage.sizes)
+	}
+	if size, _ := storage.Size("a"); size != 100 {
+		t.Errorf("expected all appends to be replayed, got size %d", size)
+	}
+}